@@ -0,0 +1,452 @@
+package analysis
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// a source of news articles about stocks
+type NewsProvider interface {
+	Fetch(ctx context.Context, ticker string) ([]Article, error)
+}
+
+const (
+	ProviderSeekingAlpha = "seekingalpha"
+	ProviderMock = "mock" // canned articles, for testing only
+)
+
+var Providers = []string{ProviderSeekingAlpha, ProviderMock} // news providers that can be selected with -provider
+
+// settings applied to whichever news provider is selected
+type ProviderOptions struct {
+	Client *http.Client // shared by every request so connections are reused
+	UserAgent string // sent with every request
+	Params neturl.Values // extra query parameters sent with every request, e.g. size=5
+}
+
+// creates the client shared by the news requests, honouring HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+func NewHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout: 30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			ForceAttemptHTTP2: true,
+			MaxIdleConns: 100,
+			MaxIdleConnsPerHost: 10, // the default of 2 would close most connections to the single news host
+			IdleConnTimeout: 90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+var errRefusedRedirect = errors.New("refusing redirect")
+
+// follows redirects on the same host only - the client would otherwise send the API key header on to whatever
+// host the API points at, or over plain HTTP after an HTTPS request
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if (len(via)>=10) {
+		return errors.New("stopped after 10 redirects")
+	}
+	from := via[0].URL
+	if (req.URL.Hostname()!=from.Hostname()) {
+		return fmt.Errorf("%w from %v to another host %v, update the API URL if it has moved", errRefusedRedirect, from.Hostname(), req.URL.Hostname())
+	}
+	if (from.Scheme=="https" && req.URL.Scheme!="https") {
+		return fmt.Errorf("%w from https to %v", errRefusedRedirect, req.URL.Scheme)
+	}
+	return nil
+}
+
+// logs every request and its response at debug level, with the values of the Redact headers and
+// Authorization replaced so API keys don't end up in the logs
+type LoggingTransport struct {
+	Base http.RoundTripper // http.DefaultTransport when nil
+	Redact []string // names of headers whose values are secret
+}
+
+func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if (base==nil) {
+		base = http.DefaultTransport
+	}
+	headers := make(map[string]string, len(req.Header))
+	for name := range req.Header {
+		headers[name] = req.Header.Get(name)
+		if (strings.EqualFold(name, "Authorization") || slices.ContainsFunc(t.Redact, func(r string) bool { return strings.EqualFold(name, r) })) {
+			headers[name] = "REDACTED"
+		}
+	}
+	url := *req.URL
+	url.RawQuery = "" // the query may carry a key too, and the ticker is in the path anyway
+
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	if (err!=nil) {
+		slog.Debug("http request failed", "method", req.Method, "url", url.Redacted(), "headers", headers, "duration", time.Since(start), "err", err)
+		return nil, err
+	}
+	slog.Debug("http request", "method", req.Method, "url", url.Redacted(), "headers", headers, "status", resp.StatusCode, "duration", time.Since(start))
+	return resp, nil
+}
+
+// creates the news provider with the given name, configured from the environment
+func NewProvider(name string, opts ProviderOptions) (NewsProvider, error) {
+	switch name {
+	case ProviderSeekingAlpha:
+		sa, err := NewSeekingAlphaFromEnv()
+		if (err!=nil) {
+			return nil, err
+		}
+		sa.Client = opts.Client
+		sa.UserAgent = opts.UserAgent
+		sa.Params = opts.Params
+		return sa, nil
+	case ProviderMock:
+		return MockProvider{}, nil
+	default:
+		return nil, fmt.Errorf("unknown news provider %q", name)
+	}
+}
+
+// returns the same canned articles for a ticker on every call without any network access -
+// for demos and testing only, the headlines are made up
+type MockProvider struct{}
+
+func (MockProvider) Fetch(ctx context.Context, ticker string) ([]Article, error) {
+	now := time.Now().Truncate(time.Hour) // recent enough to pass -news-since, stable within the hour
+	return []Article{
+		{PublishOn: now.Add(-1*time.Hour), Headline: ticker+" shares move sharply in pre-market trading"},
+		{PublishOn: now.Add(-6*time.Hour), Headline: ticker+" reports quarterly results"},
+		{PublishOn: now.Add(-24*time.Hour), Headline: "Analysts weigh in on "+ticker+" ahead of earnings"},
+	}, nil
+}
+
+// wraps a NewsProvider, keeping each ticker's articles on disk and serving them from there while younger than TTL
+type CachedProvider struct {
+	Provider NewsProvider
+	Dir string // directory holding one file per ticker
+	TTL time.Duration
+	Key string // settings the articles were fetched with, e.g. URL and query - articles fetched with others aren't served
+}
+
+type cacheEntry struct {
+	FetchedAt time.Time
+	Key string
+	Articles []Article
+}
+
+func (c *CachedProvider) Fetch(ctx context.Context, ticker string) ([]Article, error) {
+	path := filepath.Join(c.Dir, tickerFileName(ticker, ".json"))
+
+	data, err := os.ReadFile(path)
+	if (err==nil) {
+		var entry cacheEntry
+		if (json.Unmarshal(data, &entry)==nil && entry.Key==c.Key && time.Since(entry.FetchedAt)<c.TTL) {
+			slog.Debug("using cached news", "ticker", ticker, "fetched_at", entry.FetchedAt)
+			return entry.Articles, nil
+		}
+	}
+
+	articles, err := c.Provider.Fetch(ctx, ticker)
+	if (err!=nil) {
+		return nil, err
+	}
+
+	// failing to cache only costs a re-fetch next time, so it isn't an error for the caller
+	data, err = json.Marshal(cacheEntry{FetchedAt: time.Now(), Key: c.Key, Articles: articles})
+	if (err==nil) {
+		err = os.MkdirAll(c.Dir, 0o755)
+	}
+	if (err==nil) {
+		err = os.WriteFile(path, data, 0o644)
+	}
+	if (err!=nil) {
+		slog.Warn("error caching news", "ticker", ticker, "err", err)
+	}
+	return articles, nil
+}
+
+// fetches news from the Seeking Alpha API
+type SeekingAlpha struct {
+	URL string // base URL of the news endpoint, the ticker is appended to it
+	APIKeyHeader string // name of the header carrying the API key
+	APIKey string
+	UserAgent string // some gateways reject requests without one
+	Params neturl.Values // added to any query already in URL
+	Client *http.Client // http.DefaultClient when nil
+}
+
+// reads the Seeking Alpha settings from the environment, failing up front if any are missing
+// instead of failing every fetch with a confusing error
+func NewSeekingAlphaFromEnv() (*SeekingAlpha, error) {
+	var missing []string
+	for _, key := range []string{"SEEKING_ALPHA_URL", "API_KEY_HEADER", "API_KEY"} {
+		if (os.Getenv(key)=="") {
+			missing = append(missing, key)
+		}
+	}
+	if (len(missing)>0) {
+		return nil, fmt.Errorf("missing required environment variables: %v", strings.Join(missing, ", "))
+	}
+	return &SeekingAlpha{
+		URL: os.Getenv("SEEKING_ALPHA_URL"),
+		APIKeyHeader: os.Getenv("API_KEY_HEADER"),
+		APIKey: os.Getenv("API_KEY"),
+	}, nil
+}
+
+type Attributes struct {
+	PublishOn time.Time `json:"publishOn"` // to store the 'publishOn' field value from the response data
+	Title string `json:"title"` // to store the 'title' field value from the response data
+}
+
+type SeekingAlphaNews struct {
+	Attributes `json:"attributes"` // to store the 'attributes' field value from the response data
+}
+
+type SeekingAlphaResponse struct {
+	Data []SeekingAlphaNews `json:"data"` // to store the 'data' field value from the response data
+}
+
+type Article struct {
+	PublishOn time.Time `yaml:"publish_on"`
+	Headline string `yaml:"headline"`
+}
+
+// keeps the articles published after cutoff, articles without a publish time are kept as their age is unknown
+func FilterRecent(articles []Article, cutoff time.Time) []Article {
+	return slices.DeleteFunc(articles, func(a Article) bool {
+		return !a.PublishOn.IsZero() && !a.PublishOn.After(cutoff)
+	})
+}
+
+// sorts articles newest first, articles without a publish time go last, breaking ties by headline
+// so the order doesn't depend on the order the API happened to return them in
+func SortArticles(articles []Article) {
+	slices.SortStableFunc(articles, func(a, b Article) int {
+		if (a.PublishOn.IsZero() != b.PublishOn.IsZero()) {
+			if (a.PublishOn.IsZero()) {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Or(
+			b.PublishOn.Compare(a.PublishOn),
+			cmp.Compare(a.Headline, b.Headline),
+		)
+	})
+}
+
+// returns the publish time of the newest article, zero if there are no dated articles
+func LatestPublished(articles []Article) time.Time {
+	var latest time.Time
+	for _, art := range articles {
+		if (art.PublishOn.After(latest)) {
+			latest = art.PublishOn
+		}
+	}
+	return latest
+}
+
+// words that make a headline read as good or bad news for the stock
+var (
+	positiveWords = []string{"beat", "beats", "surge", "surges", "soar", "soars", "gain", "gains", "rally", "rallies", "upgrade", "upgraded", "record", "strong", "growth", "profit", "bullish", "raises", "outperform"}
+	negativeWords = []string{"miss", "misses", "plunge", "plunges", "drop", "drops", "fall", "falls", "slump", "downgrade", "downgraded", "weak", "loss", "losses", "lawsuit", "bearish", "cuts", "recall", "underperform"}
+)
+
+// scores the headlines from -1 (all negative) to 1 (all positive) by counting positive and negative words,
+// 0 when there are none - a naive heuristic meant to be replaced by a proper model
+func ScoreSentiment(articles []Article) float64 {
+	positive, negative := 0, 0
+	for _, art := range articles {
+		for _, word := range strings.FieldsFunc(strings.ToLower(art.Headline), func(r rune) bool {
+			return !unicode.IsLetter(r)
+		}) {
+			if (slices.Contains(positiveWords, word)) {
+				positive++
+			}
+			if (slices.Contains(negativeWords, word)) {
+				negative++
+			}
+		}
+	}
+	if (positive+negative==0) {
+		return 0
+	}
+	return math.Round(float64(positive-negative) / float64(positive+negative) * 100) / 100
+}
+
+// sorts articles newest first and keeps the n most recent, n of 0 keeps them all
+func LatestArticles(articles []Article, n int) []Article {
+	SortArticles(articles)
+	if (n==0 || len(articles)<=n) {
+		return articles
+	}
+	return articles[:n]
+}
+
+var (
+	MaxRetries int = 3 // no. of times a news request is retried after a transient failure
+	RetryBaseDelay = 500 * time.Millisecond // wait before the first retry, doubled after every attempt
+	MaxResponseBody int64 = 4 << 20 // bytes of a news response read before giving up, so a runaway body can't exhaust memory
+)
+
+// reports whether a request should be tried again - network errors, 429 and 5xx are transient, other 4xx are not
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if (ctx.Err()!=nil) {
+		return false // deadline elapsed or cancelled, no point in retrying
+	}
+	if (err!=nil) {
+		return !errors.Is(err, errRefusedRedirect) // following the redirect again would be refused again
+	}
+	return resp.StatusCode==http.StatusTooManyRequests || resp.StatusCode>=500
+}
+
+// reads the Retry-After header of a response, given either as seconds or as an HTTP date
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if (value=="") {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if (err==nil) {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if (err!=nil) {
+		return 0, false
+	}
+	return max(date.Sub(now), 0), true
+}
+
+const maxErrorBody = 4 << 10 // bytes of an error response body quoted in the error
+
+// reads the start of an error response body, which usually says what the API didn't like
+func bodySnippet(body io.Reader) string {
+	data, _ := io.ReadAll(io.LimitReader(body, maxErrorBody+1))
+	snippet := strings.TrimSpace(string(data[:min(len(data), maxErrorBody)]))
+	if (len(data)>maxErrorBody) {
+		snippet += "... (truncated)"
+	}
+	return snippet
+}
+
+func (sa *SeekingAlpha) Fetch(ctx context.Context, ticker string) ([]Article, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sa.URL+ticker, nil)
+	if (err!=nil) {
+		return nil, err
+	}
+	if (len(sa.Params)>0) {
+		query := req.URL.Query()
+		for key, values := range sa.Params {
+			for _, value := range values {
+				query.Add(key, value)
+			}
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	req.Header.Add(sa.APIKeyHeader, sa.APIKey)
+	if (sa.UserAgent!="") {
+		req.Header.Set("User-Agent", sa.UserAgent)
+	}
+
+	client := sa.Client
+	if (client==nil) {
+		client = http.DefaultClient
+	}
+
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		resp, err = client.Do(req) // the request has no body so it can be sent again as is
+		if (attempt>=MaxRetries || !retryable(ctx, resp, err)) {
+			if (err!=nil) {
+				return nil, fmt.Errorf("fetching news for %v: %w", ticker, err) // a deadline exceeded error surfaces here, so name the ticker that stalled
+			}
+			break
+		}
+		delay := RetryBaseDelay << attempt // exponential backoff
+		if (resp!=nil) {
+			if wait, ok := retryAfter(resp, time.Now()); ok {
+				delay = wait // the server said how long to back off, waiting is still cut short by the context deadline
+			}
+			resp.Body.Close() // discard the failed response before retrying
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("fetching news for %v: %w", ticker, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+	defer resp.Body.Close()
+	if (resp.StatusCode<200 || resp.StatusCode>299) {
+		return nil, fmt.Errorf("fetching news for %v: unsuccessful response code - %v received: %s", ticker, resp.StatusCode, bodySnippet(resp.Body))
+	}
+	// response contains 3 fields, data, included and meta
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxResponseBody+1)) // one byte over the limit tells a full body from an oversized one
+	if (err!=nil) {
+		return nil, fmt.Errorf("reading news response for %s: %w", ticker, err)
+	}
+	if (int64(len(data))>MaxResponseBody) {
+		return nil, fmt.Errorf("news response for %s exceeds %d bytes", ticker, MaxResponseBody)
+	}
+	res := &SeekingAlphaResponse{}
+	err = json.Unmarshal(data, res) // decode JSON into Go type and store into 'res'
+	if (err!=nil) {
+		return nil, fmt.Errorf("decoding news response for %s: %w", ticker, err)
+	}
+
+	var articles []Article
+
+	for _, item := range res.Data {
+		art := Article{
+			PublishOn: item.Attributes.PublishOn,
+			Headline: item.Attributes.Title,
+		}
+		articles = append(articles, art)
+	}
+
+	return DedupArticles(articles), nil
+}
+
+// removes repeated stories, keeping the first copy - two articles are the same if their headlines match
+// ignoring case and whitespace and they were published at the same instant
+func DedupArticles(articles []Article) []Article {
+	type key struct {
+		headline string
+		publishOn time.Time
+	}
+	seen := make(map[key]bool)
+	return slices.DeleteFunc(articles, func(a Article) bool {
+		k := key{
+			headline: strings.ToLower(strings.Join(strings.Fields(a.Headline), " ")),
+			publishOn: a.PublishOn.UTC(), // the same instant may come back in different zones
+		}
+		if (seen[k]) {
+			return true
+		}
+		seen[k] = true
+		return false
+	})
+}
@@ -0,0 +1,426 @@
+package analysis
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSeekingAlphaFetch(t *testing.T) {
+	defer func(delay time.Duration) { RetryBaseDelay = delay }(RetryBaseDelay)
+	defaultLimit := MaxResponseBody
+	defer func() { MaxResponseBody = defaultLimit }()
+	RetryBaseDelay = time.Millisecond // retries shouldn't slow the tests down
+
+	tests := []struct {
+		name string
+		statuses []int // status of each response in turn, the last one repeated
+		params neturl.Values
+		userAgent string
+		body string
+		maxBody int64 // MaxResponseBody for the case, the default when 0
+		want []string // headlines
+		wantErr bool
+		wantErrContains []string
+	}{
+		{
+			name: "articles",
+			statuses: []int{http.StatusOK},
+			body: `{"data": [{"attributes": {"publishOn": "2024-01-02T09:00:00Z", "title": "First"}}, {"attributes": {"publishOn": "2024-01-02T09:00:00Z", "title": " first "}}, {"attributes": {"title": "Second"}}]}`,
+			want: []string{"First", "Second"},
+		},
+		{
+			name: "query parameters",
+			statuses: []int{http.StatusOK},
+			params: neturl.Values{"size": {"5"}, "since": {"2024-01-02 09:00"}},
+			body: `{"data": []}`,
+		},
+		{
+			name: "user agent",
+			statuses: []int{http.StatusOK},
+			userAgent: "stock-analysis/1.0 (me@example.com)",
+			body: `{"data": []}`,
+		},
+		{
+			name: "no articles",
+			statuses: []int{http.StatusOK},
+			body: `{"data": []}`,
+		},
+		{
+			name: "retried after a server error",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusOK},
+			body: `{"data": [{"attributes": {"title": "First"}}]}`,
+			want: []string{"First"},
+		},
+		{
+			name: "body at the limit",
+			statuses: []int{http.StatusOK},
+			body: `{"data": []}`,
+			maxBody: int64(len(`{"data": []}`)),
+		},
+		{
+			name: "body over the limit",
+			statuses: []int{http.StatusOK},
+			body: `{"data": [{"attributes": {"title": "First"}}]}`,
+			maxBody: 16,
+			wantErr: true,
+			wantErrContains: []string{"AAPL", "exceeds 16 bytes"},
+		},
+		{
+			name: "truncated json",
+			statuses: []int{http.StatusOK},
+			body: `{"data": [{"attributes": {"title": "Fir`,
+			wantErr: true,
+		},
+		{
+			name: "html error page",
+			statuses: []int{http.StatusOK},
+			body: "<html><body>Service unavailable</body></html>",
+			wantErr: true,
+		},
+		{
+			name: "client error",
+			statuses: []int{http.StatusForbidden},
+			body: `{"message": "bad key"}`,
+			wantErr: true,
+			wantErrContains: []string{"AAPL", "403", `{"message": "bad key"}`},
+		},
+		{
+			name: "long error body truncated",
+			statuses: []int{http.StatusBadRequest},
+			body: strings.Repeat("x", maxErrorBody+100),
+			wantErr: true,
+			wantErrContains: []string{"AAPL", strings.Repeat("x", maxErrorBody)+"... (truncated)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxResponseBody = cmp.Or(tt.maxBody, defaultLimit)
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(requests.Add(1))
+				if (r.URL.Path!="/news/AAPL" || r.Header.Get("X-Key")!="secret" || r.URL.RawQuery!=tt.params.Encode() || (tt.userAgent!="" && r.UserAgent()!=tt.userAgent)) {
+					http.Error(w, "unexpected request", http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(tt.statuses[min(n, len(tt.statuses))-1])
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			sa := &SeekingAlpha{URL: server.URL+"/news/", APIKeyHeader: "X-Key", APIKey: "secret", Params: tt.params, UserAgent: tt.userAgent}
+			articles, err := sa.Fetch(context.Background(), "AAPL")
+			if (tt.wantErr) {
+				if (err==nil) {
+					t.Fatalf("got %v, want an error", articles)
+				}
+				for _, want := range tt.wantErrContains {
+					if (!strings.Contains(err.Error(), want)) {
+						t.Errorf("got error %q, want it to contain %q", err, want)
+					}
+				}
+				if (len(tt.body)>maxErrorBody && strings.Contains(err.Error(), tt.body)) {
+					t.Errorf("got the whole %d byte body in the error, want it truncated", len(tt.body))
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var headlines []string
+			for _, art := range articles {
+				headlines = append(headlines, art.Headline)
+			}
+			if (!slices.Equal(headlines, tt.want)) {
+				t.Errorf("got headlines %q, want %q", headlines, tt.want)
+			}
+		})
+	}
+}
+
+// counts the fetches that reach the provider behind a cache
+type countingProvider struct {
+	MockProvider
+	calls int
+}
+
+func (p *countingProvider) Fetch(ctx context.Context, ticker string) ([]Article, error) {
+	p.calls++
+	return p.MockProvider.Fetch(ctx, ticker)
+}
+
+func TestCachedProvider(t *testing.T) {
+	cached := []Article{{Headline: "Cached headline"}}
+	tests := []struct {
+		name string
+		cache string // contents of the ticker's cache file, none when empty
+		age time.Duration // how long ago the cached articles were fetched
+		key string // settings the cached articles were fetched with
+		wantCalls int
+	}{
+		{name: "miss", wantCalls: 1},
+		{name: "hit", cache: "entry", age: time.Minute, key: "size=5", wantCalls: 0},
+		{name: "other settings", cache: "entry", age: time.Minute, key: "size=10", wantCalls: 1},
+		{name: "expired", cache: "entry", age: time.Hour, key: "size=5", wantCalls: 1},
+		{name: "corrupt", cache: "{not json", wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tickerFileName("AAPL", ".json"))
+			if (tt.cache!="") {
+				data := []byte(tt.cache)
+				if (tt.cache=="entry") {
+					data, _ = json.Marshal(cacheEntry{FetchedAt: time.Now().Add(-tt.age), Key: tt.key, Articles: cached})
+				}
+				err := os.WriteFile(path, data, 0o644)
+				if (err!=nil) {
+					t.Fatal(err)
+				}
+			}
+
+			provider := &countingProvider{}
+			c := &CachedProvider{Provider: provider, Dir: dir, TTL: 15*time.Minute, Key: "size=5"}
+			articles, err := c.Fetch(context.Background(), "AAPL")
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (provider.calls!=tt.wantCalls) {
+				t.Errorf("got %d fetches from the provider, want %d", provider.calls, tt.wantCalls)
+			}
+			if (tt.wantCalls==0 && !slices.Equal(articles, cached)) {
+				t.Errorf("got %v, want the cached %v", articles, cached)
+			}
+			if (tt.wantCalls>0) {
+				// the fresh articles replace the cache, so a second fetch is served from it
+				_, err = c.Fetch(context.Background(), "AAPL")
+				if (err!=nil) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if (provider.calls!=tt.wantCalls) {
+					t.Errorf("got %d fetches from the provider after caching, want %d", provider.calls, tt.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		header string
+		want time.Duration
+		wantOK bool
+	}{
+		{name: "seconds", header: "120", want: 2*time.Minute, wantOK: true},
+		{name: "negative seconds", header: "-5", want: 0, wantOK: true},
+		{name: "http date", header: "Tue, 02 Jan 2024 09:00:30 GMT", want: 30*time.Second, wantOK: true},
+		{name: "date in the past", header: "Tue, 02 Jan 2024 08:59:00 GMT", want: 0, wantOK: true},
+		{name: "missing"},
+		{name: "invalid", header: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if (tt.header!="") {
+				resp.Header.Set("Retry-After", tt.header)
+			}
+			got, ok := retryAfter(resp, now)
+			if (got!=tt.want || ok!=tt.wantOK) {
+				t.Errorf("got %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestLoggingTransport(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &LoggingTransport{Redact: []string{"X-Key"}}}
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/news/AAPL?apikey=secret", nil)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Key", "secret")
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if (strings.Contains(logs.String(), "secret")) {
+		t.Errorf("got logs %q, want the key left out", logs.String())
+	}
+	for _, want := range []string{"/news/AAPL", "REDACTED", "status=418"} {
+		if (!strings.Contains(logs.String(), want)) {
+			t.Errorf("got logs %q, want them to contain %q", logs.String(), want)
+		}
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.URL.Path=="/old") {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "moved here")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL+"/new", http.StatusFound) // same host, but over plain HTTP
+	}))
+	defer secure.Close()
+	otherHost := strings.Replace(plain.URL, "127.0.0.1", "localhost", 1) // the same server under another name
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, otherHost+"/new", http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	tests := []struct {
+		name string
+		url string
+		wantErr bool
+	}{
+		{name: "same host", url: plain.URL+"/old"},
+		{name: "another host", url: redirector.URL+"/old", wantErr: true},
+		{name: "https to http", url: secure.URL+"/old", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewHTTPClient()
+			client.Transport.(*http.Transport).TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig.Clone() // trust the test certificate
+			resp, err := client.Get(tt.url)
+			if (tt.wantErr) {
+				if (!errors.Is(err, errRefusedRedirect)) {
+					t.Fatalf("got error %v, want a refused redirect", err)
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			if (resp.Request.URL.Path!="/new") {
+				t.Errorf("got %v, want the redirect followed to /new", resp.Request.URL)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClientProxy(t *testing.T) {
+	// http.ProxyFromEnvironment reads the environment once per process, so check the function rather than setting HTTPS_PROXY
+	transport, ok := NewHTTPClient().Transport.(*http.Transport)
+	if (!ok) {
+		t.Fatalf("got transport %T, want *http.Transport", NewHTTPClient().Transport)
+	}
+	if (transport.Proxy==nil || reflect.ValueOf(transport.Proxy).Pointer()!=reflect.ValueOf(http.ProxyFromEnvironment).Pointer()) {
+		t.Error("want the transport to use http.ProxyFromEnvironment")
+	}
+}
+
+func TestScoreSentiment(t *testing.T) {
+	tests := []struct {
+		name string
+		headlines []string
+		want float64
+	}{
+		{name: "no articles"},
+		{name: "no sentiment words", headlines: []string{"AAPL holds annual meeting"}},
+		{name: "positive", headlines: []string{"AAPL beats estimates", "Shares SURGE to a record"}, want: 1},
+		{name: "negative", headlines: []string{"AAPL misses estimates", "Shares plunge after downgrade"}, want: -1},
+		{name: "mixed", headlines: []string{"AAPL beats estimates, shares surge", "Analysts warn of weak demand"}, want: 0.33},
+		{name: "words, not parts of words", headlines: []string{"Beaten-down stock gains"}, want: 1},
+	}
+	for _, tt := range tests {
+		var articles []Article
+		for _, headline := range tt.headlines {
+			articles = append(articles, Article{Headline: headline})
+		}
+		got := ScoreSentiment(articles)
+		if (got!=tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterRecent(t *testing.T) {
+	cutoff := time.Date(2024, time.January, 2, 9, 0, 0, 0, time.UTC)
+	articles := []Article{
+		{Headline: "after", PublishOn: cutoff.Add(time.Second)},
+		{Headline: "at the cutoff", PublishOn: cutoff},
+		{Headline: "before", PublishOn: cutoff.Add(-time.Hour)},
+		{Headline: "undated"},
+	}
+	var got []string
+	for _, art := range FilterRecent(articles, cutoff) {
+		got = append(got, art.Headline)
+	}
+	want := []string{"after", "undated"}
+	if (!slices.Equal(got, want)) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLatestPublished(t *testing.T) {
+	newest := time.Date(2024, time.January, 2, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		articles []Article
+		want time.Time
+	}{
+		{name: "no articles"},
+		{name: "undated only", articles: []Article{{Headline: "undated"}}},
+		{name: "newest wherever it is", articles: []Article{{PublishOn: newest.Add(-time.Hour)}, {PublishOn: newest}, {}, {PublishOn: newest.Add(-48*time.Hour)}}, want: newest},
+	}
+	for _, tt := range tests {
+		got := LatestPublished(tt.articles)
+		if (!got.Equal(tt.want)) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSortArticles(t *testing.T) {
+	day := time.Date(2024, time.January, 2, 9, 0, 0, 0, time.UTC)
+	articles := []Article{
+		{Headline: "undated b"},
+		{Headline: "older", PublishOn: day.Add(-time.Hour)},
+		{Headline: "undated a"},
+		{Headline: "tie b", PublishOn: day},
+		{Headline: "tie a", PublishOn: day},
+	}
+	SortArticles(articles)
+	var got []string
+	for _, art := range articles {
+		got = append(got, art.Headline)
+	}
+	want := []string{"tie a", "tie b", "older", "undated a", "undated b"}
+	if (!slices.Equal(got, want)) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
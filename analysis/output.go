@@ -0,0 +1,396 @@
+package analysis
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatJSON = "json"
+	FormatCSV = "csv"
+	FormatYAML = "yaml"
+	FormatMarkdown = "md"
+	FormatJSONLines = "jsonl" // one selection per line, for streaming into jq and log pipelines
+)
+
+var Formats = []string{FormatJSON, FormatCSV, FormatYAML, FormatMarkdown, FormatJSONLines} // output formats supported by Deliver
+
+func Deliver(filePath, format string, selections []Selection, compress bool) error {
+	if (!slices.Contains(Formats, format)) {
+		return fmt.Errorf("unknown output format %q", format) // checked before creating the file so no empty file is left behind
+	}
+	err := os.MkdirAll(filepath.Dir(filePath), 0o755) // so results/today/opg.json works without creating results/today first
+	if (err!=nil) {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	return writeAtomic(filePath, func(w io.Writer) error {
+		if (!compress) {
+			return Encode(w, format, selections)
+		}
+		zw := gzip.NewWriter(w)
+		err := Encode(zw, format, selections)
+		if (err!=nil) {
+			zw.Close()
+			return err
+		}
+		// closing flushes the last block and writes the gzip footer, without it the file is truncated
+		err = zw.Close()
+		if (err!=nil) {
+			return fmt.Errorf("error compressing output: %w", err)
+		}
+		return nil
+	})
+}
+
+// writes a file through a temporary file in the same directory that is renamed into place once write succeeds,
+// so a crash or failed encode never leaves a half-written file at path - the temporary file is removed on failure
+func writeAtomic(path string, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if (err!=nil) {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(file.Name()) // fails harmlessly once the file has been renamed
+
+	err = write(file)
+	if (err==nil) {
+		err = file.Chmod(0o644) // CreateTemp makes the file private, output is meant to be read like any other file
+	}
+	if (err==nil) {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if (err!=nil) {
+		return err
+	}
+	if (closeErr!=nil) {
+		return fmt.Errorf("error writing file: %v", closeErr)
+	}
+	err = os.Rename(file.Name(), path)
+	if (err!=nil) {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	return nil
+}
+
+var MaxOpenFiles = 8 // files DeliverSplit writes at once, so hundreds of tickers can't exhaust file descriptors
+
+// writes each selection as JSON to its own file in dir, named after its ticker, creating dir if needed -
+// up to MaxOpenFiles are written at once, each closed as soon as it is written
+func DeliverSplit(dir string, selections []Selection) error {
+	err := os.MkdirAll(dir, 0o755)
+	if (err!=nil) {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, max(MaxOpenFiles, 1)) // holds a token for every file open
+	for _, sel := range selections {
+		sem<-struct{}{}
+		mu.Lock()
+		failed := firstErr!=nil
+		mu.Unlock()
+		if (failed) {
+			<-sem
+			break // don't keep writing once one file has failed
+		}
+		wg.Add(1)
+		go func(sel Selection) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			path := filepath.Join(dir, tickerFileName(sel.Ticker, ".json"))
+			err := writeAtomic(path, func(w io.Writer) error {
+				return newJSONEncoder(w).Encode(sel)
+			})
+			if (err!=nil) {
+				mu.Lock()
+				if (firstErr==nil) {
+					firstErr = fmt.Errorf("error writing %v: %v", sel.Ticker, err)
+				}
+				mu.Unlock()
+			}
+		} (sel)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// names the file for a ticker, escaped so a ticker can't point outside its directory
+func tickerFileName(ticker, ext string) string {
+	return neturl.PathEscape(ticker)+ext
+}
+
+// totals across every selection, to see what taking all of the trades at once would mean for the account
+type PortfolioSummary struct {
+	Positions int `yaml:"positions"`
+	CapitalDeployed float64 `yaml:"capital_deployed"` // cost of entering every position
+	ExpectedProfit float64 `yaml:"expected_profit"` // profit if every position reaches its take profit
+	WorstCaseLoss float64 `yaml:"worst_case_loss"` // loss if every position is stopped out, commission included
+}
+
+func Summarize(selections []Selection) PortfolioSummary {
+	var summary PortfolioSummary
+	for _, sel := range selections {
+		shares := sel.Shares
+		summary.Positions++
+		summary.CapitalDeployed += sel.CapitalRequired
+		summary.ExpectedProfit += sel.Profit
+		summary.WorstCaseLoss += math.Abs(sel.EntryPrice - sel.StopLossPrice) * shares + 2*CommissionPerShare*shares
+	}
+	summary.CapitalDeployed = roundTo(summary.CapitalDeployed, Precision)
+	summary.ExpectedProfit = roundTo(summary.ExpectedProfit, Precision)
+	summary.WorstCaseLoss = roundTo(summary.WorstCaseLoss, Precision)
+	return summary
+}
+
+// the document written for the json and yaml formats
+type Report struct {
+	Selections []Selection `yaml:"selections"`
+	Portfolio PortfolioSummary `yaml:"portfolio"`
+}
+
+func NewReport(selections []Selection) Report {
+	if (selections==nil) {
+		selections = []Selection{} // written as [] rather than null
+	}
+	return Report{
+		Selections: selections,
+		Portfolio: Summarize(selections),
+	}
+}
+
+var CompactJSON = false // writes JSON on a single line instead of indenting it for people to read
+
+// encodes Go types into JSON, indented unless CompactJSON is set
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	encoder := json.NewEncoder(w)
+	if (!CompactJSON) {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder
+}
+
+// reads the selections back from a JSON output file, either a report or a bare array as written by older
+// versions - a missing or empty file has no selections
+func ReadSelections(path string) ([]Selection, error) {
+	data, err := os.ReadFile(path)
+	if (errors.Is(err, fs.ErrNotExist)) {
+		return nil, nil
+	}
+	if (err!=nil) {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	data = bytes.TrimSpace(data)
+	if (len(data)==0) {
+		return nil, nil
+	}
+	var selections []Selection
+	if (data[0]=='[') {
+		err = json.Unmarshal(data, &selections)
+	} else {
+		var report Report
+		err = json.Unmarshal(data, &report)
+		selections = report.Selections
+	}
+	if (err!=nil) {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return selections, nil
+}
+
+// adds latest to existing, replacing the existing selection of any ticker in latest
+func MergeSelections(existing, latest []Selection) []Selection {
+	merged := slices.DeleteFunc(existing, func(old Selection) bool {
+		return slices.ContainsFunc(latest, func(sel Selection) bool { return sel.Ticker==old.Ticker })
+	})
+	return append(merged, latest...)
+}
+
+// writes the selections to w in the given output format
+func Encode(w io.Writer, format string, selections []Selection) error {
+	var err error
+	switch format {
+	case FormatCSV:
+		err = writeCSV(w, selections)
+	case FormatJSON:
+		err = newJSONEncoder(w).Encode(NewReport(selections))
+	case FormatYAML:
+		encoder := yaml.NewEncoder(w)
+		err = encoder.Encode(NewReport(selections))
+		if (err==nil) {
+			err = encoder.Close() // flushes any buffered output
+		}
+	case FormatMarkdown:
+		err = writeMarkdown(w, selections)
+	case FormatJSONLines:
+		encoder := json.NewEncoder(w) // never indented, each selection has to stay on its own line
+		for _, sel := range selections {
+			err = encoder.Encode(sel)
+			if (err!=nil) {
+				break
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown output format %q", format)
+	}
+	if (err!=nil) {
+		return fmt.Errorf("error encoding selections: %v", err)
+	}
+	return nil
+}
+
+// writes one flat row per selection, without the articles themselves
+func writeCSV(w io.Writer, selections []Selection) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"ticker", "gap", "opening_price", "entry_price", "shares", "take_profit", "stop_loss", "profit", "article_count", "sentiment"})
+	for _, sel := range selections {
+		writer.Write([]string{
+			sel.Ticker,
+			strconv.FormatFloat(sel.Gap, 'f', -1, 64),
+			strconv.FormatFloat(sel.OpeningPrice, 'f', -1, 64),
+			strconv.FormatFloat(sel.EntryPrice, 'f', -1, 64),
+			strconv.FormatFloat(sel.Shares, 'f', -1, 64),
+			strconv.FormatFloat(sel.TakeProfitPrice, 'f', -1, 64),
+			strconv.FormatFloat(sel.StopLossPrice, 'f', -1, 64),
+			strconv.FormatFloat(sel.Profit, 'f', -1, 64),
+			strconv.Itoa(len(sel.Articles)),
+			strconv.FormatFloat(sel.Sentiment, 'f', -1, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// sorts selections by expected profit, highest first, breaking ties by ticker so the order is deterministic
+func SortSelections(selections []Selection) {
+	slices.SortStableFunc(selections, func(a, b Selection) int {
+		return cmp.Or(
+			cmp.Compare(b.Profit, a.Profit),
+			cmp.Compare(a.Ticker, b.Ticker),
+		)
+	})
+}
+
+const (
+	SortProfit = "profit"
+	SortGap = "gap" // by absolute gap
+	SortTicker = "ticker"
+	SortNone = "none" // leave the order as it is
+)
+
+var SortKeys = []string{SortProfit, SortGap, SortTicker, SortNone}
+
+// sorts selections by the given key, descending when desc is set, breaking ties by ticker
+func SortSelectionsBy(selections []Selection, key string, desc bool) {
+	if (key==SortNone) {
+		return
+	}
+	slices.SortStableFunc(selections, func(a, b Selection) int {
+		var c int
+		switch key {
+		case SortProfit:
+			c = cmp.Compare(a.Profit, b.Profit)
+		case SortGap:
+			c = cmp.Compare(math.Abs(a.Gap), math.Abs(b.Gap))
+		case SortTicker:
+			c = cmp.Compare(a.Ticker, b.Ticker)
+		}
+		if (desc) {
+			c = -c
+		}
+		return cmp.Or(c, cmp.Compare(a.Ticker, b.Ticker))
+	})
+}
+
+// sorts selections by expected profit and keeps the n most profitable, n of 0 keeps them all
+func TopSelections(selections []Selection, n int) []Selection {
+	SortSelections(selections)
+	if (n==0 || len(selections)<=n) {
+		return selections
+	}
+	return selections[:n]
+}
+
+// writes a Markdown report with a section per selection listing the position and its headlines
+func writeMarkdown(w io.Writer, selections []Selection) error {
+	var b strings.Builder
+	b.WriteString("# Selections\n")
+	portfolio := Summarize(selections)
+	b.WriteString("\n## Portfolio\n\n")
+	fmt.Fprintf(&b, "- Positions: %d\n", portfolio.Positions)
+	fmt.Fprintf(&b, "- Capital deployed: %.2f\n", portfolio.CapitalDeployed)
+	fmt.Fprintf(&b, "- Expected profit: %.2f\n", portfolio.ExpectedProfit)
+	fmt.Fprintf(&b, "- Worst-case loss: %.2f\n", portfolio.WorstCaseLoss)
+	for _, sel := range selections {
+		fmt.Fprintf(&b, "\n## %v\n\n", sel.Ticker)
+		fmt.Fprintf(&b, "- Gap: %v\n", sel.Gap)
+		fmt.Fprintf(&b, "- Opening price: %.2f\n", sel.OpeningPrice)
+		fmt.Fprintf(&b, "- Prior close: %.2f\n", sel.PriorClose)
+		fmt.Fprintf(&b, "- Direction: %v\n", sel.Direction)
+		fmt.Fprintf(&b, "- Entry price: %.2f\n", sel.EntryPrice)
+		fmt.Fprintf(&b, "- Shares: %v (limited by %v)\n", sel.Shares, sel.LimitedBy)
+		fmt.Fprintf(&b, "- Capital required: %.2f\n", sel.CapitalRequired)
+		fmt.Fprintf(&b, "- Take profit: %.2f\n", sel.TakeProfitPrice)
+		fmt.Fprintf(&b, "- Stop loss: %.2f\n", sel.StopLossPrice)
+		fmt.Fprintf(&b, "- Expected profit: %.2f\n", sel.Profit)
+		fmt.Fprintf(&b, "- Risk/reward: %.2f\n", sel.RiskReward)
+		fmt.Fprintf(&b, "- Break-even: %.2f\n", sel.BreakEven)
+		fmt.Fprintf(&b, "- Sentiment: %.2f\n", sel.Sentiment)
+		if (sel.Warning!="") {
+			fmt.Fprintf(&b, "- Warning: %v\n", sel.Warning)
+		}
+		if (len(sel.Articles)==0) {
+			b.WriteString("- News: none\n")
+			continue
+		}
+		b.WriteString("- News:\n")
+		for _, art := range sel.Articles {
+			date := "unknown date"
+			if (!art.PublishOn.IsZero()) {
+				date = art.PublishOn.Format(time.DateOnly)
+			}
+			fmt.Fprintf(&b, "  - %v: %v\n", date, art.Headline)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// prints a table of the selections to w, best expected profit first
+func PrintSummary(selections []Selection, w io.Writer) {
+	rows := slices.Clone(selections) // sort a copy so the caller's order is untouched
+	SortSelections(rows)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TICKER\tDIRECTION\tENTRY\tSHARES\tCAPITAL\tPROFIT\tARTICLES")
+	for _, sel := range rows {
+		fmt.Fprintf(tw, "%v\t%v\t%.2f\t%v\t%.2f\t%.2f\t%d\n", sel.Ticker, sel.Direction, sel.EntryPrice, sel.Shares, sel.CapitalRequired, sel.Profit, len(sel.Articles))
+	}
+	tw.Flush()
+
+	portfolio := Summarize(selections)
+	fmt.Fprintf(w, "\n%d positions: capital deployed %.2f, expected profit %.2f, worst-case loss %.2f\n", portfolio.Positions, portfolio.CapitalDeployed, portfolio.ExpectedProfit, portfolio.WorstCaseLoss)
+	if (portfolio.CapitalDeployed>BuyingPower) {
+		fmt.Fprintf(w, "Combined positions exceed the buying power of %.2f.\n", BuyingPower)
+	}
+}
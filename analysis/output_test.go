@@ -0,0 +1,389 @@
+package analysis
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSelections = []Selection{
+	{Ticker: "AAPL", Gap: 0.2, OpeningPrice: 50, Position: Position{Direction: Long, EntryPrice: 50, Shares: 10, Profit: 30}},
+	{Ticker: "BRK/B", Gap: -0.3, OpeningPrice: 20, Position: Position{Direction: Short, EntryPrice: 20, Shares: 5, Profit: 30}},
+	{Ticker: "MSFT", Gap: 0.15, OpeningPrice: 10, Position: Position{Direction: Long, EntryPrice: 10, Shares: 20, Profit: 50}},
+}
+
+func TestDeliver(t *testing.T) {
+	tests := []struct {
+		name string
+		format string
+		compress bool
+		wantPrefix string // start of the file once decompressed
+		wantErr bool
+	}{
+		{name: "json", format: FormatJSON, wantPrefix: "{\n  \"Selections\""},
+		{name: "csv", format: FormatCSV, wantPrefix: "ticker,gap,opening_price"},
+		{name: "gzip", format: FormatJSONLines, compress: true, wantPrefix: `{"Ticker":"AAPL"`},
+		{name: "unknown format", format: "xml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out", "opg")
+			err := Deliver(path, tt.format, slices.Clone(testSelections), tt.compress)
+			if (tt.wantErr) {
+				if (err==nil) {
+					t.Fatal("want an error")
+				}
+				if _, err := os.Stat(path); err==nil {
+					t.Error("file written for a failed delivery")
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			file, err := os.Open(path)
+			if (err!=nil) {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var r io.Reader = file
+			if (tt.compress) {
+				r, err = gzip.NewReader(file)
+				if (err!=nil) {
+					t.Fatal(err)
+				}
+			}
+			data, err := io.ReadAll(r)
+			if (err!=nil) {
+				t.Fatal(err)
+			}
+			if (!strings.HasPrefix(string(data), tt.wantPrefix)) {
+				t.Errorf("got %q, want it to start with %q", data, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestDeliverSplit(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "split")
+	err := DeliverSplit(dir, testSelections)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	if (len(entries)!=len(testSelections)) {
+		t.Fatalf("got %d files, want %d", len(entries), len(testSelections))
+	}
+	for _, want := range testSelections {
+		data, err := os.ReadFile(filepath.Join(dir, tickerFileName(want.Ticker, ".json")))
+		if (err!=nil) {
+			t.Fatal(err)
+		}
+		var got Selection
+		err = json.Unmarshal(data, &got)
+		if (err!=nil) {
+			t.Fatal(err)
+		}
+		if (got.Ticker!=want.Ticker || got.Position!=want.Position) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestSortSelectionsBy(t *testing.T) {
+	tests := []struct {
+		key string
+		desc bool
+		want []string
+	}{
+		{key: SortProfit, desc: true, want: []string{"MSFT", "AAPL", "BRK/B"}}, // tied profits fall back to the ticker
+		{key: SortProfit, desc: false, want: []string{"AAPL", "BRK/B", "MSFT"}},
+		{key: SortGap, desc: true, want: []string{"BRK/B", "AAPL", "MSFT"}},
+		{key: SortTicker, desc: true, want: []string{"MSFT", "BRK/B", "AAPL"}},
+		{key: SortNone, desc: true, want: []string{"BRK/B", "MSFT", "AAPL"}},
+	}
+	for _, tt := range tests {
+		selections := []Selection{testSelections[1], testSelections[2], testSelections[0]}
+		SortSelectionsBy(selections, tt.key, tt.desc)
+		var got []string
+		for _, sel := range selections {
+			got = append(got, sel.Ticker)
+		}
+		if (!slices.Equal(got, tt.want)) {
+			t.Errorf("sorting by %v, desc %v: got %q, want %q", tt.key, tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestWriteAtomicFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		existing string // contents of the file before the write, none when empty
+	}{
+		{name: "new file"},
+		{name: "existing file", existing: "previous output\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "opg.json")
+			if (tt.existing!="") {
+				err := os.WriteFile(path, []byte(tt.existing), 0o644)
+				if (err!=nil) {
+					t.Fatal(err)
+				}
+			}
+
+			failure := errors.New("encoder failed")
+			err := writeAtomic(path, func(w io.Writer) error {
+				io.WriteString(w, `{"Selections": [`) // partway through the output
+				return failure
+			})
+			if (!errors.Is(err, failure)) {
+				t.Fatalf("got error %v, want %v", err, failure)
+			}
+
+			data, err := os.ReadFile(path)
+			if (tt.existing=="" && !errors.Is(err, os.ErrNotExist)) {
+				t.Errorf("got %q, want no file", data)
+			}
+			if (tt.existing!="" && string(data)!=tt.existing) {
+				t.Errorf("got %q, want the previous %q left alone", data, tt.existing)
+			}
+			temps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+			if (len(temps)>0) {
+				t.Errorf("got temporary files %q left behind", temps)
+			}
+		})
+	}
+}
+
+func TestAppendSelections(t *testing.T) {
+	seeded := slices.Clone(testSelections[:2]) // AAPL and BRK/B
+	legacy, _ := json.Marshal(seeded)
+	report, _ := json.Marshal(NewReport(seeded))
+	updated := testSelections[0]
+	updated.Shares = 99
+	latest := []Selection{testSelections[2], updated} // MSFT is new and AAPL replaces the earlier one
+
+	tests := []struct {
+		name string
+		existing string // contents of the output file before appending, no file when "-"
+		want []string
+		wantErr bool
+	}{
+		{name: "legacy array", existing: string(legacy), want: []string{"BRK/B", "MSFT", "AAPL"}},
+		{name: "report", existing: string(report), want: []string{"BRK/B", "MSFT", "AAPL"}},
+		{name: "missing file", existing: "-", want: []string{"MSFT", "AAPL"}},
+		{name: "empty file", existing: "\n", want: []string{"MSFT", "AAPL"}},
+		{name: "malformed", existing: `{"Selections": [`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "opg.json")
+			if (tt.existing!="-") {
+				err := os.WriteFile(path, []byte(tt.existing), 0o644)
+				if (err!=nil) {
+					t.Fatal(err)
+				}
+			}
+			existing, err := ReadSelections(path)
+			if (tt.wantErr) {
+				if (err==nil) {
+					t.Fatalf("got %+v, want an error", existing)
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			err = Deliver(path, FormatJSON, MergeSelections(existing, slices.Clone(latest)), false)
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			appended, err := ReadSelections(path)
+			if (err!=nil) {
+				t.Fatalf("unexpected error reading the appended file: %v", err)
+			}
+			var tickers []string
+			for _, sel := range appended {
+				tickers = append(tickers, sel.Ticker)
+				if (sel.Ticker=="AAPL" && sel.Shares!=updated.Shares) {
+					t.Errorf("got %v AAPL shares, want the latest %v", sel.Shares, updated.Shares)
+				}
+			}
+			if (!slices.Equal(tickers, tt.want)) {
+				t.Errorf("got %q, want %q", tickers, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	selections := []Selection{
+		{Ticker: "A", Position: Position{Direction: Long, EntryPrice: 10, StopLossPrice: 8.4, Shares: 62, CapitalRequired: 620, Profit: 99.2}},
+		{Ticker: "B", Position: Position{Direction: Short, EntryPrice: 20, StopLossPrice: 22.82, Shares: 35, CapitalRequired: 700, Profit: 98.82}},
+	}
+	tests := []struct {
+		name string
+		selections []Selection
+		commission float64
+		want PortfolioSummary
+	}{
+		{name: "no selections"},
+		{name: "long and short", selections: selections, want: PortfolioSummary{Positions: 2, CapitalDeployed: 1320, ExpectedProfit: 198.02, WorstCaseLoss: 197.9}},
+		// 97 shares pay 0.05 on the way in and again on the way out
+		{name: "with commission", selections: selections, commission: 0.05, want: PortfolioSummary{Positions: 2, CapitalDeployed: 1320, ExpectedProfit: 198.02, WorstCaseLoss: 207.6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepSettings(t)
+			CommissionPerShare = tt.commission
+			got := Summarize(tt.selections)
+			if (got!=tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopSelections(t *testing.T) {
+	tests := []struct {
+		name string
+		n int
+		want []string
+	}{
+		{name: "all", want: []string{"MSFT", "AAPL", "BRK/B"}}, // AAPL and BRK/B tie, alphabetically
+		{name: "top one", n: 1, want: []string{"MSFT"}},
+		{name: "top two", n: 2, want: []string{"MSFT", "AAPL"}},
+		{name: "more than there are", n: 10, want: []string{"MSFT", "AAPL", "BRK/B"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, sel := range TopSelections(slices.Clone(testSelections), tt.n) {
+			got = append(got, sel.Ticker)
+		}
+		if (!slices.Equal(got, tt.want)) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	selections := slices.Clone(testSelections)
+	selections[0].Articles = []Article{{Headline: "AAPL beats estimates", PublishOn: time.Date(2024, time.January, 2, 9, 0, 0, 0, time.UTC)}, {Headline: "Undated story"}}
+	var out strings.Builder
+	err := writeMarkdown(&out, selections)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := out.String()
+
+	var headers []string
+	for _, line := range strings.Split(got, "\n") {
+		if (strings.HasPrefix(line, "#")) {
+			headers = append(headers, line)
+		}
+	}
+	wantHeaders := []string{"# Selections", "## Portfolio", "## AAPL", "## BRK/B", "## MSFT"}
+	if (!slices.Equal(headers, wantHeaders)) {
+		t.Errorf("got headers %q, want %q", headers, wantHeaders)
+	}
+	for _, want := range []string{"- Positions: 3\n", "  - 2024-01-02: AAPL beats estimates\n", "  - unknown date: Undated story\n", "- News: none\n"} {
+		if (!strings.Contains(got, want)) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestCompactJSON(t *testing.T) {
+	defer func(compact bool) { CompactJSON = compact }(CompactJSON)
+
+	tests := []struct {
+		compact bool
+		wantOneLine bool
+	}{
+		{compact: true, wantOneLine: true},
+		{compact: false}, // a line per field
+	}
+	for _, tt := range tests {
+		CompactJSON = tt.compact
+		var out strings.Builder
+		err := Encode(&out, FormatJSON, testSelections)
+		if (err!=nil) {
+			t.Fatalf("compact %v: unexpected error: %v", tt.compact, err)
+		}
+		lines := strings.Count(out.String(), "\n")
+		if ((lines==1)!=tt.wantOneLine) {
+			t.Errorf("compact %v: got %d lines, want one line: %v", tt.compact, lines, tt.wantOneLine)
+		}
+		var report Report
+		err = json.Unmarshal([]byte(out.String()), &report)
+		if (err!=nil || len(report.Selections)!=len(testSelections)) {
+			t.Errorf("compact %v: got %d selections and error %v, want %d", tt.compact, len(report.Selections), err, len(testSelections))
+		}
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	for _, selections := range [][]Selection{nil, testSelections[:1], testSelections} {
+		var out strings.Builder
+		err := Encode(&out, FormatJSONLines, selections)
+		if (err!=nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		lines := strings.Count(out.String(), "\n")
+		if (lines!=len(selections)) {
+			t.Errorf("got %d lines for %d selections, want one each", lines, len(selections))
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+			if (line!="" && !json.Valid([]byte(line))) {
+				t.Errorf("got line %q, want a JSON object", line)
+			}
+		}
+	}
+}
+
+func TestDeliverSplitManyFiles(t *testing.T) {
+	defer func(limit int) { MaxOpenFiles = limit }(MaxOpenFiles)
+	MaxOpenFiles = 2
+
+	var selections []Selection
+	for i := range 300 {
+		selections = append(selections, Selection{Ticker: fmt.Sprintf("T%03d", i)})
+	}
+	openBefore, fdErr := os.ReadDir("/proc/self/fd") // only on Linux, skipped elsewhere
+	dir := filepath.Join(t.TempDir(), "split")
+	err := DeliverSplit(dir, selections)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	if (len(entries)!=len(selections)) {
+		t.Errorf("got %d files, want %d", len(entries), len(selections))
+	}
+	for _, entry := range entries {
+		if (strings.HasSuffix(entry.Name(), ".tmp")) {
+			t.Errorf("got temporary file %v left behind", entry.Name())
+		}
+	}
+	openAfter, err := os.ReadDir("/proc/self/fd")
+	if (fdErr==nil && err==nil && len(openAfter)>len(openBefore)) {
+		t.Errorf("got %d open files after writing, want no more than the %d before", len(openAfter), len(openBefore))
+	}
+}
@@ -0,0 +1,263 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+var AccountBalance float64 = 10000.0 // balance in account
+var LossTolerance float64 = 0.2 // percentage of loss that can be tolerated
+var MaxLossPerTrade = AccountBalance * LossTolerance // maximum amount of loss that can be tolerated
+var ProfitMultiplier float64 = 0.8 // percentage of gap I want to take as profit
+var StopMultiplier float64 = 0.8 // percentage of gap I am willing to lose before stopping out
+var CommissionPerShare float64 = 0 // commission paid per share, on both entry and exit
+var MaxPositionValue float64 = AccountBalance // maximum value of shares held in a single position
+var BuyingPower float64 = AccountBalance // capital available for positions, above the balance for margin accounts
+var Fractional = false // size positions in fractions of a share, for brokers that allow them
+var Precision = 2 // decimal places prices and amounts are rounded to
+var StopMode = StopModeGap // how the stop loss distance is chosen
+var StopPercent float64 = 0.02 // stop loss distance as a fraction of the entry price, used with StopModePercent
+
+const (
+	StopModeGap = "gap" // stop at StopMultiplier of the gap
+	StopModePercent = "percent" // stop at StopPercent of the entry price, whatever the gap
+)
+
+var StopModes = []string{StopModeGap, StopModePercent}
+
+// rounds a no. of shares down to what can be traded - whole shares, or 0.0001 of a share with Fractional -
+// rounding down so the position never risks more than it was sized for
+func sizeShares(shares float64) float64 {
+	if (Fractional) {
+		return math.Floor(shares*10000) / 10000
+	}
+	return math.Floor(shares)
+}
+
+// rounds value to the given no. of decimal places
+func roundTo(value float64, places int) float64 {
+	scale := math.Pow(10, float64(places))
+	return math.Round(value*scale) / scale
+}
+
+const (
+	LimitedByRisk = "risk" // sized so a stopped out trade loses MaxLossPerTrade
+	LimitedByCapital = "capital" // fewer shares than the risk allows, as they would cost more than can be spent on one position
+)
+
+const (
+	Long = "long" // buy at entry, for stocks gapping up
+	Short = "short" // sell at entry, for stocks gapping down
+)
+
+type Position struct {
+	Direction string `yaml:"direction"` // side of the trade, Long or Short
+	PriorClose float64 `yaml:"prior_close"` // previous close implied by the gap and opening price
+	EntryPrice float64 `yaml:"entry_price"` // price at which to buy/sell
+	Shares float64 `yaml:"shares"` // no. of shares to buy/sell, whole unless Fractional is set
+	CapitalRequired float64 `yaml:"capital_required"` // cash tied up by the position, EntryPrice * Shares
+	TakeProfitPrice float64 `yaml:"take_profit_price"` // price at which to exit and book profit
+	StopLossPrice float64 `yaml:"stop_loss_price"` // price at which to stop my loss if stock doesn't go my way
+	Profit float64 `yaml:"profit"` // expected final profit
+	LimitedBy string `yaml:"limited_by"` // the constraint that set the no. of shares, LimitedByRisk or LimitedByCapital
+	RiskReward float64 `yaml:"risk_reward"` // distance to take profit divided by distance to stop loss
+	BreakEven float64 `yaml:"break_even"` // exit price at which the round-trip commission is just covered
+}
+
+func Calculate(gapPercent, openingPrice float64) (Position, error) {
+	return CalculateWithMaxLoss(gapPercent, openingPrice, MaxLossPerTrade)
+}
+
+// sizes the position like Calculate but risking maxLoss instead of MaxLossPerTrade
+func CalculateWithMaxLoss(gapPercent, openingPrice, maxLoss float64) (Position, error) {
+	closingPrice := openingPrice / (1 + gapPercent)
+	gapValue := math.Abs(closingPrice - openingPrice)
+	profitFromGap := ProfitMultiplier * gapValue
+	lossFromGap := StopMultiplier * gapValue
+	if (StopMode==StopModePercent) {
+		lossFromGap = StopPercent * openingPrice
+	}
+
+	direction := Long
+	stopLoss := openingPrice - lossFromGap
+	takeProfit := openingPrice + profitFromGap
+	if (gapPercent<0) { // short the gap down - profit is taken below entry and the stop sits above it
+		direction = Short
+		stopLoss = openingPrice + lossFromGap
+		takeProfit = openingPrice - profitFromGap
+	}
+
+	stopDistance := math.Abs(stopLoss - openingPrice)
+	if (roundTo(stopDistance, Precision)==0) { // stop and entry are the same price once rounded, so there is nothing to trade
+		return Position{}, fmt.Errorf("gap of %v is too small to place a stop loss away from the entry price", gapPercent)
+	}
+
+	// a stopped out trade still pays commission on both sides, so size against the loss including fees
+	shares := sizeShares(maxLoss / (stopDistance + 2*CommissionPerShare))
+	if (shares==0) {
+		return Position{}, fmt.Errorf("risk per share of %.2f exceeds the maximum loss per trade of %.2f", stopDistance + 2*CommissionPerShare, maxLoss)
+	}
+	limitedBy := LimitedByRisk
+	capital := min(MaxPositionValue, BuyingPower)
+	if (shares*openingPrice>capital) {
+		shares = sizeShares(capital / openingPrice) // a cheap stock can't tie up more than the position cap or the buying power
+		limitedBy = LimitedByCapital
+		if (shares==0) {
+			return Position{}, fmt.Errorf("price of %.2f exceeds the %.2f available for a position", openingPrice, capital)
+		}
+	}
+
+	riskReward := math.Abs(takeProfit - openingPrice) / stopDistance
+
+	breakEven := openingPrice + 2*CommissionPerShare // entry and exit commission per share must be made back first
+	if (direction==Short) {
+		breakEven = openingPrice - 2*CommissionPerShare
+	}
+
+	profit := math.Abs(openingPrice - takeProfit) * shares
+	profit -= CommissionPerShare * shares * 2 // net of entry and exit commission
+	profit = roundTo(profit, Precision)
+
+	entryPrice := roundTo(openingPrice, Precision)
+	position := Position{
+		Direction: direction,
+		PriorClose: roundTo(closingPrice, Precision),
+		EntryPrice: entryPrice,
+		Shares: shares,
+		CapitalRequired: roundTo(entryPrice*shares, Precision),
+		LimitedBy: limitedBy,
+		TakeProfitPrice: roundTo(takeProfit, Precision),
+		StopLossPrice: roundTo(stopLoss, Precision),
+		Profit: roundTo(profit, Precision),
+		RiskReward: roundTo(riskReward, 2), // a ratio rather than a price, so it keeps two places
+		BreakEven: roundTo(breakEven, Precision),
+	}
+	// JSON can't encode NaN or Inf, so a bad stock is skipped here rather than failing the whole output
+	for _, f := range []float64{position.PriorClose, position.EntryPrice, position.Shares, position.CapitalRequired, position.TakeProfitPrice, position.StopLossPrice, position.Profit, position.RiskReward, position.BreakEven} {
+		if (!finite(f)) {
+			return Position{}, fmt.Errorf("gap of %v and opening price of %v give a non-finite position", gapPercent, openingPrice)
+		}
+	}
+	return position, nil
+}
+
+const (
+	AllocateNone = "none" // keep every position as sized
+	AllocateScale = "scale" // shrink every position by the same factor
+	AllocateDrop = "drop" // drop the least profitable positions
+)
+
+var Allocations = []string{AllocateNone, AllocateScale, AllocateDrop}
+
+// fits the combined entry cost of the selections within capital using the given mode, keeping their order,
+// leaving them untouched if they already fit
+func Allocate(selections []Selection, mode string, capital float64) []Selection {
+	total := Summarize(selections).CapitalDeployed
+	if (mode==AllocateNone || total<=capital) {
+		return selections
+	}
+
+	switch mode {
+	case AllocateScale:
+		factor := capital / total
+		for i := range selections {
+			selections[i].Position = resize(selections[i].Position, sizeShares(selections[i].Shares*factor))
+		}
+		return slices.DeleteFunc(selections, func(sel Selection) bool {
+			return sel.Shares==0 // scaled down to nothing
+		})
+	case AllocateDrop:
+		byProfit := slices.Clone(selections) // sorted apart, so the kept selections stay in the caller's order
+		SortSelections(byProfit) // most profitable first, so the least profitable are dropped from the end
+		dropped := make(map[string]bool)
+		for (len(byProfit)>0 && total>capital) {
+			last := byProfit[len(byProfit)-1]
+			total -= last.CapitalRequired
+			byProfit = byProfit[:len(byProfit)-1]
+			dropped[last.Ticker] = true
+		}
+		return slices.DeleteFunc(selections, func(sel Selection) bool {
+			return dropped[sel.Ticker]
+		})
+	}
+	return selections
+}
+
+// splits the total risk budget across stocks in proportion to their absolute gaps, so bigger gaps
+// may lose more - the budgets add up to total, split evenly when every gap is zero
+func RiskBudgets(stocks []Stock, total float64) []float64 {
+	sum := 0.0
+	for _, s := range stocks {
+		sum += math.Abs(s.Gap)
+	}
+	budgets := make([]float64, len(stocks))
+	for i, s := range stocks {
+		if (sum>0) {
+			budgets[i] = total * math.Abs(s.Gap) / sum
+		} else {
+			budgets[i] = total / float64(len(stocks)) // no gap to weight by, e.g. with -no-filter and -stop-mode percent
+		}
+	}
+	return budgets
+}
+
+// removes selections expected to make less than minProfit
+func FilterByProfit(selections []Selection, minProfit float64) []Selection {
+	return slices.DeleteFunc(selections, func(sel Selection) bool {
+		return sel.Profit<minProfit
+	})
+}
+
+// explains the conflict when the news sentiment reaches threshold against the direction of the trade -
+// negative news on a long or positive news on a short - or returns "" when they agree or threshold is 0
+func SentimentWarning(sel Selection, threshold float64) string {
+	if (threshold<=0) {
+		return ""
+	}
+	if (sel.Direction==Long && sel.Sentiment<=-threshold) {
+		return fmt.Sprintf("news sentiment of %.2f is negative against a long on a gap up, consider skipping or shorting", sel.Sentiment)
+	}
+	if (sel.Direction==Short && sel.Sentiment>=threshold) {
+		return fmt.Sprintf("news sentiment of %.2f is positive against a short on a gap down, consider skipping or going long", sel.Sentiment)
+	}
+	return ""
+}
+
+// removes selections without any articles
+func FilterByNews(selections []Selection) []Selection {
+	return slices.DeleteFunc(selections, func(sel Selection) bool {
+		return len(sel.Articles)==0
+	})
+}
+
+// removes selections whose latest news was published before cutoff, including those with no dated news at all
+func FilterByNewsAge(selections []Selection, cutoff time.Time) []Selection {
+	return slices.DeleteFunc(selections, func(sel Selection) bool {
+		return sel.LatestNews.Before(cutoff)
+	})
+}
+
+// returns p scaled down to the given no. of shares to fit the capital, with the expected profit recomputed
+func resize(p Position, shares float64) Position {
+	profit := math.Abs(p.TakeProfitPrice - p.EntryPrice) * shares
+	profit -= CommissionPerShare * shares * 2
+	p.Shares = shares
+	p.CapitalRequired = roundTo(p.EntryPrice*shares, Precision)
+	p.LimitedBy = LimitedByCapital
+	p.Profit = roundTo(profit, Precision)
+	return p
+}
+
+type Selection struct {
+	Ticker string `yaml:"ticker"`
+	Gap float64 `yaml:"gap"` // as a fraction, 0.15 for 15%, whatever the -gap-unit of the input
+	RawGap float64 `yaml:"raw_gap"` // as read from the input, before any -gap-unit conversion
+	OpeningPrice float64 `yaml:"opening_price"`
+	Position `yaml:",inline"`
+	Articles []Article `yaml:"articles"`
+	Sentiment float64 `yaml:"sentiment"` // from ScoreSentiment, -1 to 1
+	LatestNews time.Time `yaml:"latest_news"` // publish time of the newest article, zero if there is none
+	Warning string `json:",omitempty" yaml:"warning,omitempty"` // why the setup looks risky, e.g. from SentimentWarning
+}
@@ -0,0 +1,363 @@
+package analysis
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// restores the sizing settings once the test is done, so cases can change them
+func keepSettings(t *testing.T) {
+	profit, stop, commission, mode, percent, precision, fractional := ProfitMultiplier, StopMultiplier, CommissionPerShare, StopMode, StopPercent, Precision, Fractional
+	t.Cleanup(func() {
+		ProfitMultiplier, StopMultiplier, CommissionPerShare, StopMode, StopPercent, Precision, Fractional = profit, stop, commission, mode, percent, precision, fractional
+	})
+}
+
+func TestCalculateWithMaxLoss(t *testing.T) {
+	tests := []struct {
+		name string
+		settings func() // changes the defaults for the case
+		gap float64
+		openingPrice float64
+		maxLoss float64
+		want Position
+		wantErr bool
+	}{
+		{
+			name: "sized by risk",
+			gap: 0.25,
+			openingPrice: 10,
+			maxLoss: 100,
+			want: Position{Direction: Long, PriorClose: 8, EntryPrice: 10, Shares: 62, CapitalRequired: 620, TakeProfitPrice: 11.6, StopLossPrice: 8.4, Profit: 99.2, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 10},
+		},
+		{
+			name: "sized by capital",
+			gap: 0.25,
+			openingPrice: 100,
+			maxLoss: 2000,
+			want: Position{Direction: Long, PriorClose: 80, EntryPrice: 100, Shares: 100, CapitalRequired: 10000, TakeProfitPrice: 116, StopLossPrice: 84, Profit: 1600, LimitedBy: LimitedByCapital, RiskReward: 1, BreakEven: 100},
+		},
+		{
+			name: "percent stop on the same gap",
+			settings: func() { StopMode, StopPercent = StopModePercent, 0.05 },
+			gap: 0.25,
+			openingPrice: 10,
+			maxLoss: 100,
+			want: Position{Direction: Long, PriorClose: 8, EntryPrice: 10, Shares: 200, CapitalRequired: 2000, TakeProfitPrice: 11.6, StopLossPrice: 9.5, Profit: 320, LimitedBy: LimitedByRisk, RiskReward: 3.2, BreakEven: 10},
+		},
+		{
+			name: "four decimal places",
+			settings: func() { Precision = 4 },
+			gap: 0.15,
+			openingPrice: 20,
+			maxLoss: 100,
+			want: Position{Direction: Long, PriorClose: 17.3913, EntryPrice: 20, Shares: 47, CapitalRequired: 940, TakeProfitPrice: 22.087, StopLossPrice: 17.913, Profit: 98.087, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 20},
+		},
+		{
+			name: "asymmetric stop and target",
+			settings: func() { StopMultiplier, ProfitMultiplier = 0.5, 1 },
+			gap: 0.25,
+			openingPrice: 10,
+			maxLoss: 100,
+			want: Position{Direction: Long, PriorClose: 8, EntryPrice: 10, Shares: 100, CapitalRequired: 1000, TakeProfitPrice: 12, StopLossPrice: 9, Profit: 200, LimitedBy: LimitedByRisk, RiskReward: 2, BreakEven: 10},
+		},
+		{
+			name: "commission comes off the profit",
+			settings: func() { CommissionPerShare = 0.05 },
+			gap: 0.25,
+			openingPrice: 10,
+			maxLoss: 100,
+			want: Position{Direction: Long, PriorClose: 8, EntryPrice: 10, Shares: 58, CapitalRequired: 580, TakeProfitPrice: 11.6, StopLossPrice: 8.4, Profit: 87, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 10.1},
+		},
+		{
+			name: "break-even below entry on a short",
+			settings: func() { CommissionPerShare = 0.05 },
+			gap: -0.25,
+			openingPrice: 10,
+			maxLoss: 100,
+			want: Position{Direction: Short, PriorClose: 13.33, EntryPrice: 10, Shares: 36, CapitalRequired: 360, TakeProfitPrice: 7.33, StopLossPrice: 12.67, Profit: 92.4, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 9.9},
+		},
+		{
+			name: "15% gap up is a long",
+			gap: 0.15,
+			openingPrice: 20,
+			maxLoss: 100,
+			want: Position{Direction: Long, PriorClose: 17.39, EntryPrice: 20, Shares: 47, CapitalRequired: 940, TakeProfitPrice: 22.09, StopLossPrice: 17.91, Profit: 98.09, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 20},
+		},
+		{
+			name: "15% gap down is a short",
+			gap: -0.15,
+			openingPrice: 20,
+			maxLoss: 100,
+			want: Position{Direction: Short, PriorClose: 23.53, EntryPrice: 20, Shares: 35, CapitalRequired: 700, TakeProfitPrice: 17.18, StopLossPrice: 22.82, Profit: 98.82, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 20},
+		},
+		{
+			name: "prior close rounded up",
+			gap: 0.2,
+			openingPrice: 50,
+			maxLoss: 90,
+			want: Position{Direction: Long, PriorClose: 41.67, EntryPrice: 50, Shares: 13, CapitalRequired: 650, TakeProfitPrice: 56.67, StopLossPrice: 43.33, Profit: 86.67, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 50},
+		},
+		{
+			name: "prior close rounded down",
+			gap: -0.07,
+			openingPrice: 123.45,
+			maxLoss: 100,
+			want: Position{Direction: Short, PriorClose: 132.74, EntryPrice: 123.45, Shares: 13, CapitalRequired: 1604.85, TakeProfitPrice: 116.02, StopLossPrice: 130.88, Profit: 96.64, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 123.45},
+		},
+		{
+			name: "whole shares",
+			gap: 0.25,
+			openingPrice: 2000,
+			maxLoss: 1000,
+			want: Position{Direction: Long, PriorClose: 1600, EntryPrice: 2000, Shares: 3, CapitalRequired: 6000, TakeProfitPrice: 2320, StopLossPrice: 1680, Profit: 960, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 2000},
+		},
+		{
+			name: "fractional shares",
+			settings: func() { Fractional = true },
+			gap: 0.25,
+			openingPrice: 2000,
+			maxLoss: 1000,
+			want: Position{Direction: Long, PriorClose: 1600, EntryPrice: 2000, Shares: 3.125, CapitalRequired: 6250, TakeProfitPrice: 2320, StopLossPrice: 1680, Profit: 1000, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 2000},
+		},
+		{
+			name: "fraction of a share",
+			settings: func() { Fractional = true },
+			gap: 0.25,
+			openingPrice: 2000,
+			maxLoss: 100,
+			want: Position{Direction: Long, PriorClose: 1600, EntryPrice: 2000, Shares: 0.3125, CapitalRequired: 625, TakeProfitPrice: 2320, StopLossPrice: 1680, Profit: 100, LimitedBy: LimitedByRisk, RiskReward: 1, BreakEven: 2000},
+		},
+		{
+			name: "no whole share within the maximum loss",
+			gap: 0.25,
+			openingPrice: 2000,
+			maxLoss: 100,
+			wantErr: true,
+		},
+		{
+			name: "gap too small for a stop",
+			gap: 0.0001,
+			openingPrice: 10,
+			maxLoss: 100,
+			wantErr: true,
+		},
+		{
+			name: "risk per share above the maximum loss",
+			gap: 0.25,
+			openingPrice: 10,
+			maxLoss: 1,
+			wantErr: true,
+		},
+		{
+			name: "price above the capital for a position",
+			gap: 0.25,
+			openingPrice: 20000,
+			maxLoss: 100000,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepSettings(t)
+			if (tt.settings!=nil) {
+				tt.settings()
+			}
+			got, err := CalculateWithMaxLoss(tt.gap, tt.openingPrice, tt.maxLoss)
+			if (tt.wantErr) {
+				if (err==nil) {
+					t.Fatalf("got %+v, want an error", got)
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (got!=tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+			// the gap applied to the prior close has to give back the opening price
+			if (roundTo(got.PriorClose*(1+tt.gap), Precision)!=got.EntryPrice) {
+				t.Errorf("prior close %v with a gap of %v gives %v, want the entry price %v", got.PriorClose, tt.gap, got.PriorClose*(1+tt.gap), got.EntryPrice)
+			}
+		})
+	}
+}
+
+func TestRoundTo(t *testing.T) {
+	tests := []struct {
+		places int
+		want float64
+	}{
+		{places: 0, want: 123},
+		{places: 2, want: 123.46},
+		{places: 4, want: 123.4568},
+	}
+	for _, tt := range tests {
+		got := roundTo(123.456789, tt.places)
+		if (got!=tt.want) {
+			t.Errorf("%d places: got %v, want %v", tt.places, got, tt.want)
+		}
+	}
+}
+
+func TestRiskBudgets(t *testing.T) {
+	tests := []struct {
+		name string
+		gaps []float64
+		want []float64
+	}{
+		{name: "no stocks"},
+		{name: "bigger gaps get more", gaps: []float64{0.1, -0.3, 0.2, 0.4}, want: []float64{100, 300, 200, 400}},
+		{name: "equal gaps", gaps: []float64{0.2, -0.2}, want: []float64{500, 500}},
+		{name: "all zero gaps", gaps: []float64{0, 0, 0, 0}, want: []float64{250, 250, 250, 250}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stocks []Stock
+			for _, gap := range tt.gaps {
+				stocks = append(stocks, Stock{Gap: gap})
+			}
+			budgets := RiskBudgets(stocks, 1000)
+			if (len(budgets)!=len(tt.want)) {
+				t.Fatalf("got %d budgets, want %d", len(budgets), len(tt.want))
+			}
+			sum := 0.0
+			for i, budget := range budgets {
+				if (math.Abs(budget-tt.want[i])>1e-9) {
+					t.Errorf("budget %d: got %v, want %v", i, budget, tt.want[i])
+				}
+				sum += budget
+			}
+			if (len(budgets)>0 && math.Abs(sum-1000)>1e-9) {
+				t.Errorf("budgets add up to %v, want 1000", sum)
+			}
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	// capital of 1, 300 and 500, making a profit of 1, 30 and 50
+	selections := []Selection{
+		{Ticker: "C", Position: Position{EntryPrice: 1, Shares: 1, CapitalRequired: 1, TakeProfitPrice: 2, Profit: 1}},
+		{Ticker: "B", Position: Position{EntryPrice: 100, Shares: 3, CapitalRequired: 300, TakeProfitPrice: 110, Profit: 30}},
+		{Ticker: "A", Position: Position{EntryPrice: 10, Shares: 50, CapitalRequired: 500, TakeProfitPrice: 11, Profit: 50}},
+	}
+	tests := []struct {
+		name string
+		mode string
+		capital float64
+		wantTickers []string
+		wantShares []float64
+	}{
+		{name: "none keeps everything", mode: AllocateNone, capital: 100, wantTickers: []string{"C", "B", "A"}, wantShares: []float64{1, 3, 50}},
+		{name: "already fits", mode: AllocateScale, capital: 801, wantTickers: []string{"C", "B", "A"}, wantShares: []float64{1, 3, 50}},
+		{name: "scale by half, dropping what rounds to nothing", mode: AllocateScale, capital: 400.5, wantTickers: []string{"B", "A"}, wantShares: []float64{1, 25}},
+		{name: "drop the least profitable", mode: AllocateDrop, capital: 800, wantTickers: []string{"B", "A"}, wantShares: []float64{3, 50}},
+		{name: "drop down to one", mode: AllocateDrop, capital: 799, wantTickers: []string{"A"}, wantShares: []float64{50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepSettings(t)
+			CommissionPerShare, Fractional = 0, false
+			got := Allocate(slices.Clone(selections), tt.mode, tt.capital)
+			var tickers []string
+			var shares []float64
+			for _, sel := range got {
+				tickers = append(tickers, sel.Ticker)
+				shares = append(shares, sel.Shares)
+			}
+			if (!slices.Equal(tickers, tt.wantTickers) || !slices.Equal(shares, tt.wantShares)) {
+				t.Errorf("got %q with shares %v, want %q with %v", tickers, shares, tt.wantTickers, tt.wantShares)
+			}
+			deployed := Summarize(got).CapitalDeployed
+			if (tt.mode!=AllocateNone && deployed>tt.capital) {
+				t.Errorf("got %v capital deployed, want at most %v", deployed, tt.capital)
+			}
+		})
+	}
+}
+
+func TestSentimentWarning(t *testing.T) {
+	tests := []struct {
+		name string
+		direction string
+		sentiment float64
+		threshold float64
+		wantWarning bool
+	}{
+		{name: "positive news on a long", direction: Long, sentiment: 0.8, threshold: 0.5},
+		{name: "negative news on a short", direction: Short, sentiment: -0.8, threshold: 0.5},
+		{name: "negative news on a long", direction: Long, sentiment: -0.8, threshold: 0.5, wantWarning: true},
+		{name: "positive news on a short", direction: Short, sentiment: 0.8, threshold: 0.5, wantWarning: true},
+		{name: "at the threshold", direction: Long, sentiment: -0.5, threshold: 0.5, wantWarning: true},
+		{name: "below the threshold", direction: Long, sentiment: -0.4, threshold: 0.5},
+		{name: "warnings off", direction: Long, sentiment: -1, threshold: 0},
+	}
+	for _, tt := range tests {
+		sel := Selection{Ticker: "AAPL", Position: Position{Direction: tt.direction}, Sentiment: tt.sentiment}
+		got := SentimentWarning(sel, tt.threshold)
+		if ((got!="")!=tt.wantWarning) {
+			t.Errorf("%v: got warning %q, want one: %v", tt.name, got, tt.wantWarning)
+		}
+	}
+}
+
+func TestFilterByProfit(t *testing.T) {
+	tests := []struct {
+		name string
+		minProfit float64
+		want []string
+	}{
+		{name: "no minimum", want: []string{"A", "B", "C"}},
+		{name: "minimum is inclusive", minProfit: 50, want: []string{"B", "C"}},
+		{name: "above every profit", minProfit: 1000},
+	}
+	for _, tt := range tests {
+		selections := []Selection{{Ticker: "A", Position: Position{Profit: 49.99}}, {Ticker: "B", Position: Position{Profit: 50}}, {Ticker: "C", Position: Position{Profit: 120}}}
+		var got []string
+		for _, sel := range FilterByProfit(selections, tt.minProfit) {
+			got = append(got, sel.Ticker)
+		}
+		if (!slices.Equal(got, tt.want)) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterByNewsAge(t *testing.T) {
+	cutoff := time.Date(2024, time.January, 2, 9, 0, 0, 0, time.UTC)
+	selections := []Selection{
+		{Ticker: "RECENT", LatestNews: cutoff.Add(time.Hour)},
+		{Ticker: "AT", LatestNews: cutoff},
+		{Ticker: "OLD", LatestNews: cutoff.Add(-time.Hour)},
+		{Ticker: "NONE"}, // no dated news
+	}
+	var got []string
+	for _, sel := range FilterByNewsAge(selections, cutoff) {
+		got = append(got, sel.Ticker)
+	}
+	want := []string{"RECENT", "AT"}
+	if (!slices.Equal(got, want)) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFilterByNews(t *testing.T) {
+	selections := []Selection{
+		{Ticker: "NEWS", Articles: []Article{{Headline: "AAPL beats estimates"}}},
+		{Ticker: "NONE"},
+		{Ticker: "EMPTY", Articles: []Article{}},
+		{Ticker: "MORE", Articles: []Article{{Headline: "First"}, {Headline: "Second"}}},
+	}
+	var got []string
+	for _, sel := range FilterByNews(selections) {
+		got = append(got, sel.Ticker)
+	}
+	want := []string{"NEWS", "MORE"}
+	if (!slices.Equal(got, want)) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
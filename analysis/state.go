@@ -0,0 +1,66 @@
+package analysis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tickers already analysed, kept between runs so a re-run on the same day can skip them
+type State struct {
+	Processed map[string]string `json:"processed"` // ticker to the day it was last analysed, as YYYY-MM-DD
+}
+
+// reads the state saved at path, a missing file is an empty state as nothing has been processed yet
+func LoadState(path string) (State, error) {
+	state := State{Processed: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if (errors.Is(err, fs.ErrNotExist)) {
+		return state, nil
+	}
+	if (err!=nil) {
+		return state, fmt.Errorf("reading %s: %w", path, err)
+	}
+	err = json.Unmarshal(data, &state)
+	if (err!=nil) {
+		return state, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	if (state.Processed==nil) {
+		state.Processed = make(map[string]string)
+	}
+	return state, nil
+}
+
+// reports whether ticker was analysed on the same day as now
+func (s State) Done(ticker string, now time.Time) bool {
+	return s.Processed[ticker]==now.Format(time.DateOnly)
+}
+
+// records tickers as analysed on the day of now, forgetting tickers from earlier days
+func (s *State) Mark(tickers []string, now time.Time) {
+	today := now.Format(time.DateOnly)
+	for ticker, day := range s.Processed {
+		if (day!=today) {
+			delete(s.Processed, ticker)
+		}
+	}
+	for _, ticker := range tickers {
+		s.Processed[ticker] = today
+	}
+}
+
+// writes the state to path, creating its directory if needed
+func SaveState(path string, s State) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if (err!=nil) {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	return writeAtomic(path, func(w io.Writer) error {
+		return newJSONEncoder(w).Encode(s)
+	})
+}
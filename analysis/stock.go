@@ -0,0 +1,415 @@
+// Package analysis loads gapping stocks, sizes a trade for each one and gathers news about them.
+package analysis
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type Stock struct {
+	Ticker string
+	Gap float64 // as a fraction, 0.15 for 15%
+	RawGap float64 // as read from the input, before any -gap-unit conversion
+	OpeningPrice float64
+}
+
+const (
+	GapFraction = "fraction" // 0.15 means 15%
+	GapPercent = "percent" // 15 means 15%
+)
+
+var GapUnit = GapFraction // unit of the gaps in the input files
+var Delimiter = ',' // separates the fields of CSV input, some European exports use ';'
+
+// converts a gap read from the input into the fraction Calculate expects
+func gapFraction(gap float64) float64 {
+	if (GapUnit==GapPercent) {
+		return gap / 100
+	}
+	return gap
+}
+
+// a row of the input that could not be turned into a stock
+type SkippedRow struct {
+	Path string // input file the row came from
+	LineNumber int // line of the row in a CSV file, or position of the record in a JSON array
+	Raw []string
+	Reason string
+}
+
+// loads stocks from the CSV file at path, or from stdin when path is "-", along with the rows that had to be skipped
+func Load(path string) ([]Stock, []SkippedRow, error) {
+	if (path=="-") {
+		stocks, skipped, err := loadFrom(os.Stdin)
+		if (err != nil) {
+			return nil, nil, fmt.Errorf("reading stdin: %w", err)
+		}
+		return stocks, withPath(skipped, path), nil
+	}
+
+	file, err := os.Open(path)
+	if (err != nil) {
+		return nil, nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	
+	defer file.Close() // always close the file before ending execution in case of any error in the program ahead
+	
+	stocks, skipped, err := loadFrom(file)
+	if (err != nil) {
+		return nil, nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return stocks, withPath(skipped, path), nil
+}
+
+func withPath(skipped []SkippedRow, path string) []SkippedRow {
+	for i := range skipped {
+		skipped[i].Path = path
+	}
+	return skipped
+}
+
+func loadFrom(r io.Reader) ([]Stock, []SkippedRow, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = Delimiter
+	reader.FieldsPerRecord = -1 // rows may be ragged, short ones are skipped below instead of failing the whole file
+
+	header, err := reader.Read()
+	if (err==io.EOF) {
+		return nil, nil, nil // empty file, not even a header
+	}
+	if (err != nil) {
+		return nil, nil, err
+	}
+	cols, err := columns(header)
+	if (err != nil) {
+		return nil, nil, err
+	}
+	
+	var stocks []Stock
+	var skipped []SkippedRow
+	
+	for {
+		row, err := reader.Read()
+		if (err==io.EOF) {
+			break
+		}
+		if (err != nil) {
+			return nil, nil, err
+		}
+		line, _ := reader.FieldPos(0) // exact even when quoted fields span several lines
+		skip := func(reason string) {
+			skipped = append(skipped, SkippedRow{LineNumber: line, Raw: row, Reason: reason})
+		}
+
+		if (len(row)<=max(cols.ticker, cols.gap, cols.opening)) {
+			skip(fmt.Sprintf("missing columns, only %d fields", len(row)))
+			continue
+		}
+		ticker := normalizeTicker(row[cols.ticker])
+		gap, err := strconv.ParseFloat(row[cols.gap], 64)
+		if (err!=nil) {
+			skip(fmt.Sprintf("invalid gap %q", row[cols.gap]))
+			continue
+		}
+		openingPrice, err := strconv.ParseFloat(row[cols.opening], 64)
+		if (err!=nil) {
+			skip(fmt.Sprintf("invalid opening price %q", row[cols.opening]))
+			continue
+		}
+		stock := Stock{
+			Ticker: ticker,
+			Gap: gapFraction(gap),
+			RawGap: gap,
+			OpeningPrice: openingPrice,
+		}
+		if reason := implausible(stock); reason!="" {
+			skip(reason)
+			continue
+		}
+		stocks = append(stocks, stock)
+	}
+	
+	return stocks, skipped, nil
+}
+
+// indices of the columns Load reads
+type columnIndex struct {
+	ticker int
+	gap int
+	opening int
+}
+
+// finds the ticker, gap and opening price columns in the header, matching names case-insensitively
+// so brokers exporting the columns in any order are read correctly
+func columns(header []string) (columnIndex, error) {
+	cols := columnIndex{-1, -1, -1}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name=="ticker" && cols.ticker<0:
+			cols.ticker = i
+		case name=="gap" && cols.gap<0:
+			cols.gap = i
+		case strings.HasPrefix(name, "opening") && cols.opening<0: // e.g. "Opening Price"
+			cols.opening = i
+		}
+	}
+
+	var missing []string
+	if (cols.ticker<0) {
+		missing = append(missing, "ticker")
+	}
+	if (cols.gap<0) {
+		missing = append(missing, "gap")
+	}
+	if (cols.opening<0) {
+		missing = append(missing, "opening price")
+	}
+	if (len(missing)>0) {
+		return cols, fmt.Errorf("header is missing required columns: %v", strings.Join(missing, ", "))
+	}
+	return cols, nil
+}
+
+// reports whether f is an actual number, not NaN or infinite
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// trims and upper-cases a ticker, as exports often carry ones like " aapl " that the news API doesn't recognise
+func normalizeTicker(ticker string) string {
+	return strings.ToUpper(strings.TrimSpace(ticker))
+}
+
+// explains what is wrong with the prices of s, or returns "" if they make sense - bad data would otherwise produce bizarre positions
+func implausible(s Stock) string {
+	if (s.Ticker=="") {
+		return "missing ticker"
+	}
+	if (!finite(s.Gap) || !finite(s.OpeningPrice)) { // ParseFloat accepts NaN and Inf, which would poison every calculation
+		return fmt.Sprintf("non-finite gap %v or opening price %v", s.Gap, s.OpeningPrice)
+	}
+	if (s.OpeningPrice<=0) {
+		return fmt.Sprintf("non-positive opening price %v", s.OpeningPrice)
+	}
+	if (s.Gap<=-1) { // a fall of 100% or more means the previous close was not positive
+		return fmt.Sprintf("gap of %v is -100%% or less", s.Gap)
+	}
+	return ""
+}
+
+// loads stocks from a JSON array of {ticker, gap, openingPrice} objects at path, or from stdin when path is "-"
+func LoadJSON(path string) ([]Stock, []SkippedRow, error) {
+	if (path=="-") {
+		stocks, skipped, err := loadJSONFrom(os.Stdin)
+		if (err!=nil) {
+			return nil, nil, fmt.Errorf("reading stdin: %w", err)
+		}
+		return stocks, withPath(skipped, path), nil
+	}
+
+	file, err := os.Open(path)
+	if (err!=nil) {
+		return nil, nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer file.Close()
+
+	stocks, skipped, err := loadJSONFrom(file)
+	if (err!=nil) {
+		return nil, nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return stocks, withPath(skipped, path), nil
+}
+
+func loadJSONFrom(r io.Reader) ([]Stock, []SkippedRow, error) {
+	var records []Stock
+	err := json.NewDecoder(r).Decode(&records) // field names are matched case-insensitively, so no tags are needed on Stock
+	if (err!=nil) {
+		return nil, nil, fmt.Errorf("decoding stocks: %w", err)
+	}
+
+	var stocks []Stock
+	var skipped []SkippedRow
+	for i, stock := range records {
+		stock.Ticker = normalizeTicker(stock.Ticker)
+		stock.RawGap = stock.Gap
+		stock.Gap = gapFraction(stock.Gap)
+		if reason := implausible(stock); reason!="" {
+			skipped = append(skipped, SkippedRow{
+				LineNumber: i+1,
+				Raw: []string{stock.Ticker, strconv.FormatFloat(stock.RawGap, 'f', -1, 64), strconv.FormatFloat(stock.OpeningPrice, 'f', -1, 64)},
+				Reason: reason,
+			})
+			continue
+		}
+		stocks = append(stocks, stock)
+	}
+	return stocks, skipped, nil
+}
+
+// loads stocks with the loader for format, which is detected from the file extension when empty
+func LoadInput(path, format string) ([]Stock, []SkippedRow, error) {
+	if (format=="") {
+		format = FormatCSV
+		if (strings.EqualFold(filepath.Ext(path), ".json")) {
+			format = FormatJSON
+		}
+	}
+	switch format {
+	case FormatCSV:
+		return Load(path)
+	case FormatJSON:
+		return LoadJSON(path)
+	default:
+		return nil, nil, fmt.Errorf("unknown input format %q", format)
+	}
+}
+
+// loads and concatenates the stocks and skipped rows of every path
+func LoadAll(paths []string, format string) ([]Stock, []SkippedRow, error) {
+	var stocks []Stock
+	var skipped []SkippedRow
+	for _, path := range paths {
+		loaded, skippedRows, err := LoadInput(path, format)
+		if (err!=nil) {
+			return nil, nil, err // already names the file
+		}
+		stocks = append(stocks, loaded...)
+		skipped = append(skipped, skippedRows...)
+	}
+	return stocks, skipped, nil
+}
+
+const (
+	DupFirst = "first" // keep the first row of a ticker
+	DupLargest = "largest" // keep the row with the largest absolute gap
+	DupError = "error" // fail on a repeated ticker
+)
+
+var DupPolicies = []string{DupFirst, DupLargest, DupError}
+
+// leaves one stock per ticker, choosing which by policy, or fails on the first repeated ticker with DupError
+func DedupStocks(stocks []Stock, policy string) ([]Stock, error) {
+	kept := make(map[string]int) // ticker to its index in deduped
+	var deduped []Stock
+	for _, s := range stocks {
+		i, seen := kept[s.Ticker]
+		if (!seen) {
+			kept[s.Ticker] = len(deduped)
+			deduped = append(deduped, s)
+			continue
+		}
+		switch policy {
+		case DupError:
+			return nil, fmt.Errorf("ticker %v appears more than once, with gaps %v and %v", s.Ticker, deduped[i].Gap, s.Gap)
+		case DupLargest:
+			if (math.Abs(s.Gap)>math.Abs(deduped[i].Gap)) {
+				deduped[i] = s // keeps the position of the first row so the input order is unchanged
+			}
+		}
+		slog.Debug("skipping duplicate ticker", "ticker", s.Ticker, "policy", policy)
+	}
+	return deduped, nil
+}
+
+// builds an upper-cased ticker set from values, where a value naming an existing file is read as
+// a list of tickers separated by commas or newlines, with # starting a comment
+func TickerSet(values []string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, value := range values {
+		info, err := os.Stat(value)
+		if (err!=nil || info.IsDir()) {
+			set[strings.ToUpper(value)] = true
+			continue
+		}
+		data, err := os.ReadFile(value)
+		if (err!=nil) {
+			return nil, fmt.Errorf("reading %s: %w", value, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			for _, ticker := range strings.Split(line, ",") {
+				ticker = strings.TrimSpace(ticker)
+				if (ticker!="") {
+					set[strings.ToUpper(ticker)] = true
+				}
+			}
+		}
+	}
+	return set, nil
+}
+
+// keeps only stocks in only (every stock when only is empty) and drops stocks in exclude, exclude wins when a ticker is in both
+func FilterByTicker(stocks []Stock, only, exclude map[string]bool) []Stock {
+	return slices.DeleteFunc(stocks, func(s Stock) bool {
+		ticker := strings.ToUpper(s.Ticker)
+		if (exclude[ticker]) {
+			slog.Debug("skipping excluded ticker", "ticker", s.Ticker)
+			return true
+		}
+		return len(only)>0 && !only[ticker]
+	})
+}
+
+// spread of the absolute gaps across a set of stocks, to judge whether a day is volatile enough to trade
+type GapSummary struct {
+	Count int
+	Min float64
+	Max float64
+	Mean float64
+}
+
+// summarises the absolute gaps of stocks, all zero for no stocks
+func GapStats(stocks []Stock) GapSummary {
+	var summary GapSummary
+	for i, s := range stocks {
+		gap := math.Abs(s.Gap)
+		if (i==0 || gap<summary.Min) {
+			summary.Min = gap
+		}
+		summary.Max = max(summary.Max, gap)
+		summary.Mean += gap
+	}
+	summary.Count = len(stocks)
+	if (summary.Count>0) {
+		summary.Mean /= float64(summary.Count)
+	}
+	return summary
+}
+
+// removes stocks opening below minPrice or above maxPrice, a bound of 0 is not checked
+func FilterByPrice(stocks []Stock, minPrice, maxPrice float64) []Stock {
+	return slices.DeleteFunc(stocks, func(s Stock) bool {
+		return s.OpeningPrice<minPrice || (maxPrice>0 && s.OpeningPrice>maxPrice)
+	})
+}
+
+// removes stocks whose absolute gap is below minGap, a minGap of 0 keeps every stock
+func FilterByGap(stocks []Stock, minGap float64) []Stock {
+	return slices.DeleteFunc(stocks, func(s Stock) bool {
+		return math.Abs(s.Gap) < minGap
+	})
+}
+
+// removes stocks whose absolute gap is above maxGap as likely bad data, a maxGap of 0 keeps every stock
+func FilterByMaxGap(stocks []Stock, maxGap float64) []Stock {
+	if (maxGap==0) {
+		return stocks
+	}
+	return slices.DeleteFunc(stocks, func(s Stock) bool {
+		if (math.Abs(s.Gap)>maxGap) {
+			slog.Warn("skipping stock with implausible gap", "ticker", s.Ticker, "gap", s.Gap)
+			return true
+		}
+		return false
+	})
+}
@@ -0,0 +1,340 @@
+package analysis
+
+import (
+	"cmp"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadFrom(t *testing.T) {
+	defer func(unit string) { GapUnit = unit }(GapUnit)
+	defer func(delimiter rune) { Delimiter = delimiter }(Delimiter)
+
+	tests := []struct {
+		name string
+		gapUnit string // GapFraction when empty
+		delimiter rune // a comma when 0
+		input string
+		want []Stock
+		wantSkipped []SkippedRow
+		wantErr bool
+	}{
+		{
+			name: "columns in any order",
+			input: "Opening Price,Gap,Ticker\n50,0.2, aapl \n20,-0.15,MSFT\n",
+			want: []Stock{{Ticker: "AAPL", Gap: 0.2, RawGap: 0.2, OpeningPrice: 50}, {Ticker: "MSFT", Gap: -0.15, RawGap: -0.15, OpeningPrice: 20}},
+		},
+		{
+			name: "gaps in percent",
+			gapUnit: GapPercent,
+			input: "ticker,gap,opening\nAAPL,15,50\n",
+			want: []Stock{{Ticker: "AAPL", Gap: 0.15, RawGap: 15, OpeningPrice: 50}},
+		},
+		{
+			name: "semicolon delimiter",
+			delimiter: ';',
+			input: "ticker;gap;opening\nAAPL;0.2;50\nBRK,B;-0.15;20\n",
+			want: []Stock{{Ticker: "AAPL", Gap: 0.2, RawGap: 0.2, OpeningPrice: 50}, {Ticker: "BRK,B", Gap: -0.15, RawGap: -0.15, OpeningPrice: 20}},
+		},
+		{
+			name: "bad rows skipped",
+			input: "ticker,gap,opening\nA,x,10\nB,0.2\nC,0.2,-5\nD,NaN,10\nE,0.2,10\n",
+			want: []Stock{{Ticker: "E", Gap: 0.2, RawGap: 0.2, OpeningPrice: 10}},
+			wantSkipped: []SkippedRow{
+				{LineNumber: 2, Raw: []string{"A", "x", "10"}, Reason: `invalid gap "x"`},
+				{LineNumber: 3, Raw: []string{"B", "0.2"}, Reason: "missing columns, only 2 fields"},
+				{LineNumber: 4, Raw: []string{"C", "0.2", "-5"}, Reason: "non-positive opening price -5"},
+				{LineNumber: 5, Raw: []string{"D", "NaN", "10"}, Reason: "non-finite gap NaN or opening price 10"},
+			},
+		},
+		{
+			name: "line numbers after a multi-line field",
+			input: "ticker,gap,opening,note\nA,0.2,10,\"line one\nline two\"\nB,x,10,\n",
+			want: []Stock{{Ticker: "A", Gap: 0.2, RawGap: 0.2, OpeningPrice: 10}},
+			wantSkipped: []SkippedRow{{LineNumber: 4, Raw: []string{"B", "x", "10", ""}, Reason: `invalid gap "x"`}},
+		},
+		{
+			name: "empty input",
+			input: "",
+		},
+		{
+			name: "missing column",
+			input: "ticker,gap\nA,0.2\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			GapUnit = cmp.Or(tt.gapUnit, GapFraction)
+			Delimiter = cmp.Or(tt.delimiter, ',')
+			stocks, skipped, err := loadFrom(strings.NewReader(tt.input))
+			if (tt.wantErr) {
+				if (err==nil) {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (!slices.Equal(stocks, tt.want)) {
+				t.Errorf("got stocks %+v, want %+v", stocks, tt.want)
+			}
+			sameRow := func(a, b SkippedRow) bool {
+				return a.LineNumber==b.LineNumber && a.Reason==b.Reason && slices.Equal(a.Raw, b.Raw)
+			}
+			if (!slices.EqualFunc(skipped, tt.wantSkipped, sameRow)) {
+				t.Errorf("got skipped %+v, want %+v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		input string
+		want []Stock
+		wantSkipped int
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			input: `[{"ticker": "aapl", "gap": 0.2, "openingPrice": 50}]`,
+			want: []Stock{{Ticker: "AAPL", Gap: 0.2, RawGap: 0.2, OpeningPrice: 50}},
+		},
+		{
+			name: "implausible skipped",
+			input: `[{"ticker": "A", "gap": -1, "openingPrice": 50}, {"ticker": "", "gap": 0.2, "openingPrice": 50}, {"ticker": "B", "gap": 0.2, "openingPrice": 5}]`,
+			want: []Stock{{Ticker: "B", Gap: 0.2, RawGap: 0.2, OpeningPrice: 5}},
+			wantSkipped: 2,
+		},
+		{
+			name: "malformed",
+			input: `[{"ticker": "A",`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "stocks.json")
+			err := os.WriteFile(path, []byte(tt.input), 0o644)
+			if (err!=nil) {
+				t.Fatal(err)
+			}
+			stocks, skipped, err := LoadJSON(path)
+			if (tt.wantErr) {
+				if (err==nil) {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (!slices.Equal(stocks, tt.want)) {
+				t.Errorf("got stocks %+v, want %+v", stocks, tt.want)
+			}
+			if (len(skipped)!=tt.wantSkipped) {
+				t.Errorf("got %d skipped rows, want %d", len(skipped), tt.wantSkipped)
+			}
+			for _, row := range skipped {
+				if (row.Path!=path) {
+					t.Errorf("got skipped row path %q, want %q", row.Path, path)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupStocks(t *testing.T) {
+	stocks := []Stock{
+		{Ticker: "AAPL", Gap: 0.1, OpeningPrice: 50},
+		{Ticker: "MSFT", Gap: 0.2, OpeningPrice: 20},
+		{Ticker: "AAPL", Gap: -0.3, OpeningPrice: 40},
+		{Ticker: "AAPL", Gap: 0.2, OpeningPrice: 45},
+	}
+	tests := []struct {
+		policy string
+		input []Stock
+		want []Stock
+		wantErr bool
+	}{
+		{policy: DupFirst, input: stocks, want: []Stock{stocks[0], stocks[1]}},
+		{policy: DupLargest, input: stocks, want: []Stock{stocks[2], stocks[1]}},
+		{policy: DupError, input: stocks, wantErr: true},
+		{policy: DupError, input: stocks[:2], want: stocks[:2]},
+	}
+	for _, tt := range tests {
+		got, err := DedupStocks(slices.Clone(tt.input), tt.policy)
+		if (tt.wantErr) {
+			if (err==nil) {
+				t.Errorf("%v: got %+v, want an error", tt.policy, got)
+			}
+			continue
+		}
+		if (err!=nil) {
+			t.Errorf("%v: unexpected error: %v", tt.policy, err)
+			continue
+		}
+		if (!slices.Equal(got, tt.want)) {
+			t.Errorf("%v: got %+v, want %+v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestFilterByPrice(t *testing.T) {
+	tests := []struct {
+		name string
+		minPrice float64
+		maxPrice float64
+		want []string
+	}{
+		{name: "unbounded", want: []string{"A", "B", "C", "D"}},
+		{name: "bounds are inclusive", minPrice: 5, maxPrice: 50, want: []string{"B", "C"}},
+		{name: "no maximum", minPrice: 5, want: []string{"B", "C", "D"}},
+		{name: "no minimum", maxPrice: 50, want: []string{"A", "B", "C"}},
+		{name: "single price", minPrice: 50, maxPrice: 50, want: []string{"C"}},
+	}
+	for _, tt := range tests {
+		stocks := []Stock{{Ticker: "A", OpeningPrice: 4.99}, {Ticker: "B", OpeningPrice: 5}, {Ticker: "C", OpeningPrice: 50}, {Ticker: "D", OpeningPrice: 50.01}}
+		var got []string
+		for _, s := range FilterByPrice(stocks, tt.minPrice, tt.maxPrice) {
+			got = append(got, s.Ticker)
+		}
+		if (!slices.Equal(got, tt.want)) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterByGap(t *testing.T) {
+	tests := []struct {
+		name string
+		minGap float64
+		want []string
+	}{
+		{name: "no minimum", want: []string{"A", "B", "C", "D", "E"}},
+		{name: "minimum is inclusive both ways", minGap: 0.1, want: []string{"B", "C", "E"}},
+		{name: "above every gap", minGap: 0.6},
+	}
+	for _, tt := range tests {
+		stocks := []Stock{{Ticker: "A", Gap: 0.0999}, {Ticker: "B", Gap: 0.1}, {Ticker: "C", Gap: -0.1}, {Ticker: "D", Gap: -0.0999}, {Ticker: "E", Gap: 0.5}}
+		var got []string
+		for _, s := range FilterByGap(stocks, tt.minGap) {
+			got = append(got, s.Ticker)
+		}
+		if (!slices.Equal(got, tt.want)) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGapStats(t *testing.T) {
+	tests := []struct {
+		name string
+		gaps []float64
+		want GapSummary
+	}{
+		{name: "no stocks"},
+		{name: "one stock", gaps: []float64{-0.2}, want: GapSummary{Count: 1, Min: 0.2, Max: 0.2, Mean: 0.2}},
+		{name: "absolute gaps", gaps: []float64{0.1, -0.4, 0.25, -0.05}, want: GapSummary{Count: 4, Min: 0.05, Max: 0.4, Mean: 0.2}},
+	}
+	for _, tt := range tests {
+		var stocks []Stock
+		for _, gap := range tt.gaps {
+			stocks = append(stocks, Stock{Gap: gap})
+		}
+		got := GapStats(stocks)
+		if (got.Count!=tt.want.Count || got.Min!=tt.want.Min || got.Max!=tt.want.Max || math.Abs(got.Mean-tt.want.Mean)>1e-9) {
+			t.Errorf("%v: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterByTicker(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "watchlist.txt")
+	err := os.WriteFile(file, []byte("# morning watchlist\nmsft, nvda\n\nTSLA # earnings today\n"), 0o644)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		only []string
+		exclude []string
+		want []string
+	}{
+		{name: "no lists", want: []string{"AAPL", "MSFT", "NVDA", "TSLA"}},
+		{name: "only", only: []string{"aapl", "MSFT"}, want: []string{"AAPL", "MSFT"}},
+		{name: "exclude", exclude: []string{"nvda"}, want: []string{"AAPL", "MSFT", "TSLA"}},
+		{name: "exclude beats only", only: []string{"AAPL", "MSFT"}, exclude: []string{"MSFT"}, want: []string{"AAPL"}},
+		{name: "only from a file", only: []string{file}, want: []string{"MSFT", "NVDA", "TSLA"}},
+		{name: "file and ticker mixed", only: []string{file, "AAPL"}, exclude: []string{"TSLA"}, want: []string{"AAPL", "MSFT", "NVDA"}},
+	}
+	for _, tt := range tests {
+		only, err := TickerSet(tt.only)
+		if (err!=nil) {
+			t.Fatalf("%v: unexpected error: %v", tt.name, err)
+		}
+		exclude, err := TickerSet(tt.exclude)
+		if (err!=nil) {
+			t.Fatalf("%v: unexpected error: %v", tt.name, err)
+		}
+		stocks := []Stock{{Ticker: "AAPL"}, {Ticker: "MSFT"}, {Ticker: "NVDA"}, {Ticker: "TSLA"}}
+		var got []string
+		for _, s := range FilterByTicker(stocks, only, exclude) {
+			got = append(got, s.Ticker)
+		}
+		if (!slices.Equal(got, tt.want)) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadAll(t *testing.T) {
+	dir := t.TempDir()
+	morning := filepath.Join(dir, "morning.csv")
+	err := os.WriteFile(morning, []byte("ticker,gap,opening\nAAPL,0.1,50\nMSFT,0.2,20\nBAD,x,10\n"), 0o644)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	extra := filepath.Join(dir, "extra.csv")
+	err = os.WriteFile(extra, []byte("ticker,gap,opening\nNVDA,-0.15,100\naapl,-0.3,45\n"), 0o644)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+
+	stocks, skipped, err := LoadAll([]string{morning, extra}, "")
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var tickers []string
+	for _, s := range stocks {
+		tickers = append(tickers, s.Ticker)
+	}
+	wantTickers := []string{"AAPL", "MSFT", "NVDA", "AAPL"}
+	if (!slices.Equal(tickers, wantTickers)) {
+		t.Errorf("got %q, want the rows of both files in order %q", tickers, wantTickers)
+	}
+	if (len(skipped)!=1 || skipped[0].Path!=morning) {
+		t.Errorf("got skipped %+v, want the bad row of %v", skipped, morning)
+	}
+
+	deduped, err := DedupStocks(stocks, DupFirst)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []Stock{{Ticker: "AAPL", Gap: 0.1, RawGap: 0.1, OpeningPrice: 50}, {Ticker: "MSFT", Gap: 0.2, RawGap: 0.2, OpeningPrice: 20}, {Ticker: "NVDA", Gap: -0.15, RawGap: -0.15, OpeningPrice: 100}}
+	if (!slices.Equal(deduped, want)) {
+		t.Errorf("got %+v, want the first file's AAPL kept %+v", deduped, want)
+	}
+
+	_, _, err = LoadAll([]string{morning, filepath.Join(dir, "missing.csv")}, "")
+	if (err==nil || !strings.Contains(err.Error(), "missing.csv")) {
+		t.Errorf("got error %v, want one naming the missing file", err)
+	}
+}
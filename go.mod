@@ -2,4 +2,6 @@ module github.com/ramananubhaw/Stock-Analysis-CLI-in-Go
 
 go 1.23.0
 
-require github.com/joho/godotenv v1.5.1 // indirect
+require github.com/joho/godotenv v1.5.1
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -1,239 +1,1006 @@
 package main
 
 import (
-	"encoding/csv"
+	"bufio"
+	"cmp"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"math"
-	"net/http"
+	neturl "net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
 	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/joho/godotenv"
-	// "sync"
+	"github.com/ramananubhaw/Stock-Analysis-CLI-in-Go/analysis"
 )
+// runs fn on every item in its own goroutine and gathers the results it keeps, in the order they complete -
+// fn returns false to leave an item out. The results channel is only closed once every goroutine is done,
+// so this returns cleanly for no items at all or when some items produce nothing
+func fanIn[T any](items []T, fn func(T) (T, bool)) []T {
+	var wg sync.WaitGroup
+	results := make(chan T, len(items))
+	for _, item := range items {
+		wg.Add(1)
+		go func(item T) {
+			defer wg.Done()
+			if result, ok := fn(item); ok {
+				results<-result
+			}
+		} (item) // calling the above anonymous function on 'item'
+	}
 
-type Stock struct {
-	Ticker string
-	Gap float64
-	OpeningPrice float64
-}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-func Load(path string) ([]Stock, error) {
-	file, err := os.Open(path)
-	if (err != nil) {
-		fmt.Println(err)
-		return nil, err
-	}
-	
-	defer file.Close() // always close the file before ending execution in case of any error in the program ahead
-	
-	reader := csv.NewReader(file)
-	rows, err := reader.ReadAll()
-	if (err != nil) {
-		fmt.Println(err)
-		return nil, err
-	}
-
-	rows = slices.Delete(rows, 0, 1)
-	
-	var stocks []Stock
-	
-	for _, row := range rows {
-		ticker := row[0]
-		gap, err := strconv.ParseFloat(row[1], 64)
-		if (err!=nil) {
-			continue
-		}
-		openingPrice, err := strconv.ParseFloat(row[2], 64)
-		if (err!=nil) {
-			continue
-		}
-		stocks = append(stocks, Stock{
-			Ticker: ticker,
-			Gap: gap,
-			OpeningPrice: openingPrice,
-		})
+	var collected []T
+	for result := range results {
+		collected = append(collected, result)
 	}
-	
-	return stocks, nil
+	return collected
+}
+
+// names the file partial results are written to, e.g. opg.json becomes opg.partial.json
+func partialPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext)+".partial"+ext
+}
+
+// draws an "n/total done, ETA ~Xs" counter in place on a terminal line, clearing it around
+// anything else written through it so log lines don't get mixed into the counter
+type Progress struct {
+	mu sync.Mutex
+	w io.Writer
+	done int
+	total int
+	workers int // fetches running at once, which the remaining ones are shared between
+	recent []time.Duration // the last fetch durations the ETA is averaged over
 }
 
-var accountBalance float64 = 10000.0 // balance in account
-var lossTolerance float64 = 0.2 // percentage of loss that can be tolerated
-var maxLossPerTrade = accountBalance * lossTolerance // maximum amount of loss that can be tolerated
-var profitPercent float64 = 0.8 // percentage of gap I want to take as profit
+const etaWindow = 20 // no. of recent fetches averaged for the ETA, so it follows the API slowing down or speeding up
 
-type Position struct {
-	EntryPrice float64 // price at which to buy/sell
-	Shares int // no. of shares to buy/sell
-	TakeProfitPrice float64 // price at which to exit and book profit
-	StopLossPrice float64 // price at which to stop my loss if stock doesn't go my way
-	Profit float64 // expected final profit
+func NewProgress(w io.Writer) *Progress {
+	return &Progress{w: w}
 }
 
-func Calculate(gapPercent, openingPrice float64) Position {
-	closingPrice := openingPrice / (1 + gapPercent)
-	gapValue := closingPrice - openingPrice
-	profitFromGap := profitPercent * gapValue
+// shows the counter for total fetches, run workers at a time, starting again from zero on every -watch pass
+func (p *Progress) Start(total, workers int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+	p.workers = workers
+	p.done = 0
+	p.recent = nil // the last pass's durations would skew the ETA of this one
+	p.draw()
+}
 
-	stopLoss := openingPrice - profitFromGap
-	takeProfit := openingPrice + profitFromGap
+// counts one more completed fetch that took d
+func (p *Progress) Increment(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.recent = append(p.recent, d)
+	if (len(p.recent)>etaWindow) {
+		p.recent = p.recent[1:]
+	}
+	p.draw()
+}
 
-	shares := int(maxLossPerTrade / math.Abs(stopLoss - openingPrice))
+// estimates the time left for remaining fetches from the average of the recent durations,
+// with workers fetches running at once - zero when nothing has completed yet
+func eta(recent []time.Duration, remaining, workers int) time.Duration {
+	if (len(recent)==0 || workers<1) {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range recent {
+		sum += d
+	}
+	average := sum / time.Duration(len(recent))
+	batches := (remaining + workers - 1) / workers // the last batch may not fill every worker
+	return average * time.Duration(batches)
+}
 
-	profit := math.Abs(openingPrice - takeProfit) * float64(shares)
-	profit = math.Round(profit*100) / 100
+// ends the counter's line so later output starts on a fresh one
+func (p *Progress) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if (p.total>0) {
+		fmt.Fprintln(p.w)
+	}
+	p.total = 0
+}
 
-	return Position{
-		EntryPrice: math.Round(openingPrice*100) / 100,
-		Shares: shares,
-		TakeProfitPrice: math.Round(takeProfit*100) / 100,
-		StopLossPrice: math.Round(stopLoss*100) / 100,
-		Profit: math.Round(profit*100) / 100,
+// writes b on its own line and redraws the counter below it
+func (p *Progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if (p.total>0) {
+		fmt.Fprint(p.w, "\r\033[K") // clear the counter before writing over it
 	}
+	n, err := p.w.Write(b)
+	p.draw()
+	return n, err
 }
 
-type Selection struct {
-	Ticker string
-	Position
-	Articles []Article
+func (p *Progress) draw() {
+	if (p.total>0) {
+		fmt.Fprintf(p.w, "\r%d/%d done", p.done, p.total)
+		if left := eta(p.recent, p.total-p.done, p.workers); left>0 {
+			fmt.Fprintf(p.w, ", ETA ~%v", left.Round(time.Second))
+		}
+		fmt.Fprint(p.w, "\033[K") // clear what is left of a longer previous line
+	}
 }
 
+// reports whether w is a terminal, the counter is only drawn there as the carriage returns garble files and pipes
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if (!ok) {
+		return false
+	}
+	info, err := file.Stat()
+	return err==nil && info.Mode()&os.ModeCharDevice!=0
+}
 
+// set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.date=...",
+// otherwise filled in from the build info embedded by the go tool
 var (
-	url string
-	apiKeyHeader string
-	apiKey string
+	version = ""
+	commit = ""
+	date = ""
 )
 
-type Attributes struct {
-	PublishOn time.Time `json:"publishOn"` // to store the 'publishOn' field value from the response data
-	Title string `json:"title"` // to store the 'title' field value from the response data
-}
-
-type SeekingAlphaNews struct {
-	Attributes `json:"attributes"` // to store the 'attributes' field value from the response data
+// returns the version, commit and build date of the running binary
+func buildInfo() (string, string, string) {
+	v, c, d := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if (v=="") {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key=="vcs.revision" && c=="":
+				c = setting.Value
+			case setting.Key=="vcs.time" && d=="":
+				d = setting.Value
+			}
+		}
+	}
+	return cmp.Or(v, "unknown"), cmp.Or(c, "unknown"), cmp.Or(d, "unknown")
 }
 
-type SeekingAlphaResponse struct {
-	Data []SeekingAlphaNews `json:"data"` // to store the 'data' field value from the response data
+// names the tool and its version, e.g. stock-analysis/v1.2.3
+func defaultUserAgent() string {
+	v, _, _ := buildInfo()
+	return "stock-analysis/"+v
 }
 
-type Article struct {
-	PublishOn time.Time
-	Headline string
+// settings shared through a config file instead of flags - fields left out keep their defaults
+type Config struct {
+	Balance *float64 `json:"balance"`
+	LossTolerance *float64 `json:"lossTolerance"`
+	ProfitMultiplier *float64 `json:"profitMultiplier"`
+	StopMultiplier *float64 `json:"stopMultiplier"`
+	MinGap *float64 `json:"minGap"`
+	SeekingAlphaURL string `json:"seekingAlphaUrl"` // used when SEEKING_ALPHA_URL is not set
+	APIKeyHeader string `json:"apiKeyHeader"` // used when API_KEY_HEADER is not set
+	APIKey string `json:"apiKey"` // used when API_KEY is not set
 }
 
-func FetchNews(ticker string) ([]Article, error) {
-	req, err := http.NewRequest(http.MethodGet, url+ticker, nil)
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	file, err := os.Open(path)
 	if (err!=nil) {
-		return nil, err
+		return config, fmt.Errorf("opening config %s: %w", path, err)
 	}
-	req.Header.Add(apiKeyHeader, apiKey)
+	defer file.Close()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields() // catch misspelt settings instead of silently ignoring them
+	err = decoder.Decode(&config)
 	if (err!=nil) {
-		return nil, err
+		return config, fmt.Errorf("decoding config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// sets the flags of fs from the config, except the ones already given on the command line,
+// and the API settings that aren't already in the environment
+func (c Config) Apply(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	values := map[string]*float64{
+		"balance": c.Balance,
+		"loss-tolerance": c.LossTolerance,
+		"profit-multiplier": c.ProfitMultiplier,
+		"stop-multiplier": c.StopMultiplier,
+		"min-gap": c.MinGap,
+	}
+	for name, value := range values {
+		if (value==nil || given[name]) {
+			continue
+		}
+		err := fs.Set(name, strconv.FormatFloat(*value, 'f', -1, 64))
+		if (err!=nil) {
+			return err
+		}
 	}
-	if (resp.StatusCode<200 || resp.StatusCode>299) {
-		return nil, fmt.Errorf("unsuccessful response code - %v received", resp.StatusCode)
+
+	env := map[string]string{
+		"SEEKING_ALPHA_URL": c.SeekingAlphaURL,
+		"API_KEY_HEADER": c.APIKeyHeader,
+		"API_KEY": c.APIKey,
+	}
+	for key, value := range env {
+		if (value!="" && os.Getenv(key)=="") {
+			os.Setenv(key, value)
+		}
 	}
-	// response contains 3 fields, data, included and meta
+	return nil
+}
 
-	res := &SeekingAlphaResponse{}
-	json.NewDecoder(resp.Body).Decode(res) // decode JSON into Go type and store into 'res'
+// a flag that can be repeated or given a comma-separated list, collecting every value -
+// the default values are replaced by the first value set
+type listFlag struct {
+	values []string
+	set bool
+}
 
-	var articles []Article
+func (l *listFlag) String() string {
+	return strings.Join(l.values, ",")
+}
 
-	for _, item := range res.Data {
-		art := Article{
-			PublishOn: item.Attributes.PublishOn,
-			Headline: item.Attributes.Title,
+func (l *listFlag) Set(value string) error {
+	if (!l.set) {
+		l.values = nil
+		l.set = true
+	}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if (item!="") {
+			l.values = append(l.values, item)
 		}
-		articles = append(articles, art)
 	}
+	return nil
+}
 
-	return articles, nil
+// a repeatable key=value flag collecting query parameters
+type paramsFlag struct {
+	values neturl.Values
 }
 
-func Deliver(filePath string, selections []Selection) error {
-	file, err := os.Create(filePath)
-	if (err!=nil) {
-		return fmt.Errorf("error creating file: %v", err)
+func (p *paramsFlag) String() string {
+	return p.values.Encode()
+}
+
+func (p *paramsFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if (!ok || key=="") {
+		return fmt.Errorf("%q is not a key=value pair", value)
 	}
-	defer file.Close()
-	encoder := json.NewEncoder(file) // encode Go type into JSON
-	err = encoder.Encode(selections)
-	if (err!=nil) {
-		return fmt.Errorf("error encoding selections: %v", err)
+	if (p.values==nil) {
+		p.values = make(neturl.Values)
 	}
+	p.values.Add(key, val)
 	return nil
 }
 
 func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if (errors.Is(err, flag.ErrHelp)) {
+		return // usage has already been printed
+	}
+	if (err!=nil) {
+		slog.Error("stock analysis failed", "err", err)
+		os.Exit(1)
+	}
+}
 
-	godotenv.Load()
+// position of ticker among the candidates, selections from an earlier run merged in by -append go last
+func inputOrder(candidates []analysis.Selection, ticker string) int {
+	i := slices.IndexFunc(candidates, func(sel analysis.Selection) bool { return sel.Ticker==ticker })
+	if (i<0) {
+		return len(candidates)
+	}
+	return i
+}
 
-	stocks, err := Load("./opg.csv")
-	if (err!=nil) {
-		fmt.Println(err)
+// how long fetching the news about a ticker took, including retries
+type fetchTiming struct {
+	ticker string
+	duration time.Duration
+}
+
+// logs the median and 95th percentile fetch times and the slowest tickers
+func logTimings(timings []fetchTiming) {
+	if (len(timings)==0) {
 		return
 	}
+	slices.SortFunc(timings, func(a, b fetchTiming) int {
+		return cmp.Compare(a.duration, b.duration)
+	})
+	percentile := func(p float64) time.Duration {
+		return timings[int(math.Ceil(p*float64(len(timings))))-1].duration // nearest rank
+	}
+	var slowest []string
+	for _, t := range slices.Backward(timings[max(len(timings)-3, 0):]) {
+		slowest = append(slowest, fmt.Sprintf("%v (%v)", t.ticker, t.duration.Round(time.Millisecond)))
+	}
+	slog.Info("fetch timings", "fetches", len(timings), "p50", percentile(0.5), "p95", percentile(0.95), "slowest", strings.Join(slowest, ", "))
+}
+
+// runs analyse every interval until ctx is cancelled, returning the error of a pass the cancellation cut short
+func watchLoop(ctx context.Context, interval time.Duration, analyse func() error) error {
+	for {
+		slog.Info("starting analysis", "time", time.Now().Format(time.RFC3339))
+		err := analyse()
+		if (ctx.Err()!=nil) {
+			return err
+		}
+		if (err!=nil) {
+			slog.Error("analysis failed, trying again next time", "err", err) // a bad pass shouldn't end the morning's monitoring
+		}
+		select {
+		case <-ctx.Done():
+			slog.Info("stopped watching")
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// asks question on out and reports whether the answer read from in is yes, anything else counts as no
+func askYesNo(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprint(out, question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer=="y" || answer=="yes"
+}
+
+// runs the whole analysis with the given command-line arguments, reading answers to prompts from stdin,
+// writing the summary to stdout and logs to stderr
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+
+	fs := flag.NewFlagSet("stock-analysis", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	inputPaths := &listFlag{values: []string{"./opg.csv"}}
+	fs.Var(inputPaths, "input", "comma-separated or repeated paths of the CSV or JSON files containing the stocks to analyse, - reads from stdin")
+	dupPolicy := fs.String("dup-policy", analysis.DupFirst, "what to do with a ticker in the input more than once - first, largest (gap) or error")
+	delimiter := fs.String("delimiter", ",", "single character separating the fields of CSV input, e.g. ; for some European exports")
+	inputFormat := fs.String("input-format", "", "format of the input file, csv or json - detected from the extension when empty")
+	onlyTickers := &listFlag{}
+	fs.Var(onlyTickers, "only", "only analyse these tickers, comma-separated or repeated, a value naming a file is read as a list of tickers")
+	excludeTickers := &listFlag{}
+	fs.Var(excludeTickers, "exclude", "never analyse these tickers, takes precedence over -only, accepts files like -only")
+	outputPath := fs.String("output", "./opg.json", "path of the file to write the selections to")
+	format := fs.String("format", analysis.FormatJSON, "format of the output file, json, jsonl, csv, yaml or md")
+	fs.BoolVar(&analysis.CompactJSON, "compact", analysis.CompactJSON, "write JSON on a single line instead of indenting it")
+	confirm := fs.Bool("confirm", false, "show the summary and ask before writing the output file")
+	appendOutput := fs.Bool("append", false, "merge the selections into those already in the JSON -output file, replacing older ones for the same ticker")
+	gzipOutput := fs.Bool("gzip", false, "gzip-compress the output file, appending .gz to its name")
+	fs.IntVar(&analysis.MaxOpenFiles, "max-open-files", analysis.MaxOpenFiles, "no. of files -split-output writes at once")
+	splitOutput := fs.Bool("split-output", false, "write one JSON file per ticker into the -output directory instead of a single file")
+	validateOnly := fs.Bool("validate-only", false, "check the flags, config, environment and input, print OK and exit without fetching news or writing output")
+	dryRun := fs.Bool("dry-run", false, "print the output to stdout instead of writing the output file")
+	timeout := fs.Duration("timeout", 10*time.Second, "deadline for each news request")
+	watch := fs.Duration("watch", 0, "repeat the analysis at this interval, reloading the input and rewriting the output, until interrupted")
+	deadline := fs.Duration("deadline", 0, "deadline for the whole run, after which partial results are written, 0 for none")
+	fs.IntVar(&analysis.MaxRetries, "max-retries", analysis.MaxRetries, "no. of times a news request is retried on 429/5xx responses and network errors")
+	fs.Int64Var(&analysis.MaxResponseBody, "max-response-size", analysis.MaxResponseBody, "maximum size in bytes of a news response body")
+	fs.DurationVar(&analysis.RetryBaseDelay, "retry-delay", analysis.RetryBaseDelay, "base delay between retries, doubled after every attempt")
+	fs.StringVar(&analysis.GapUnit, "gap-unit", analysis.GapFraction, "unit of the gaps in the input, fraction (0.15) or percent (15)")
+	minGap := fs.Float64("min-gap", 0.1, "minimum absolute gap (as a fraction) for a stock to be considered, 0 disables filtering")
+	minPrice := fs.Float64("min-price", 0, "drop stocks opening below this price, e.g. penny stocks, 0 disables the check")
+	maxPrice := fs.Float64("max-price", 0, "drop stocks opening above this price, 0 disables the check")
+	noFilter := fs.Bool("no-filter", false, "analyse every stock whatever its gap, ignoring -min-gap - -max-gap still discards bad data")
+	maxGap := fs.Float64("max-gap", 0, "discard stocks with an absolute gap above this as bad data, e.g. 5 for 500%, 0 disables the check")
+	stateFile := fs.String("state-file", "", "file recording the tickers analysed today, which later runs on the same day skip - needs -append so their earlier selections stay in the output")
+	force := fs.Bool("force", false, "analyse tickers again even if the -state-file says they were analysed today")
+	sentimentOverride := fs.Float64("sentiment-override", 0, "warn about selections whose news sentiment reaches this, in (0,1], against the trade direction, 0 disables")
+	requireNews := fs.Bool("require-news", false, "drop selections without any articles, after -news-since is applied")
+	maxNewsAge := fs.Duration("max-news-age", 0, "drop selections whose latest news is older than this, or that have no news, 0 keeps them all")
+	sortKey := fs.String("sort", analysis.SortProfit, "order of the output - profit, gap, ticker or none for the input order")
+	sortDesc := fs.Bool("sort-desc", false, "sort in descending order, the default for profit and gap, -sort-desc=false for ascending")
+	top := fs.Int("top", 0, "only output the n selections with the highest expected profit, 0 outputs all")
+	minProfit := fs.Float64("min-profit", 0, "drop selections expected to make less than this, 0 disables the filter")
+	allocation := fs.String("allocation", analysis.AllocateNone, "how to fit positions whose combined cost exceeds the buying power - none, scale or drop")
+	providerName := fs.String("provider", analysis.ProviderSeekingAlpha, "news provider to fetch articles from - "+strings.Join(analysis.Providers, ", "))
+	newsParams := &paramsFlag{}
+	fs.Var(newsParams, "news-params", "key=value query parameter added to every news request, e.g. size=5, can be repeated")
+	userAgent := fs.String("user-agent", defaultUserAgent(), "User-Agent header sent with news requests")
+	mockNews := fs.Bool("mock-news", false, "use made-up articles instead of a real provider, for testing only - same as -provider mock")
+	noNews := fs.Bool("no-news", false, "skip fetching news, only size the positions")
+	newsSince := fs.Duration("news-since", 48*time.Hour, "only keep articles published within this window, 0 keeps all")
+	maxArticles := fs.Int("max-articles", 10, "maximum no. of articles kept per stock, newest first, 0 keeps all")
+	cacheTTL := fs.Duration("cache-ttl", 15*time.Minute, "reuse news fetched within this long ago from the on-disk cache")
+	noCache := fs.Bool("no-cache", false, "always fetch news from the provider, bypassing the cache")
+	showProgress := fs.Bool("progress", false, "show a counter of completed news fetches on stderr, only when it is a terminal")
+	concurrency := fs.Int("concurrency", 4, "maximum no. of news requests in flight at once")
+	fs.Float64Var(&analysis.AccountBalance, "balance", analysis.AccountBalance, "balance in account")
+	fs.Float64Var(&analysis.LossTolerance, "loss-tolerance", analysis.LossTolerance, "fraction of the balance that can be lost per trade, in (0,1]")
+	fs.Float64Var(&analysis.MaxPositionValue, "max-position-value", 0, "maximum value of shares held in a single position, 0 uses the buying power")
+	weightByGap := fs.Bool("weight-by-gap", false, "split the maximum loss per trade across all stocks in proportion to their gaps instead of risking it on each")
+	fs.Float64Var(&analysis.BuyingPower, "buying-power", 0, "capital available for positions, above the balance for margin accounts, 0 uses the balance")
+	fs.BoolVar(&analysis.Fractional, "fractional", analysis.Fractional, "size positions in fractions of a share instead of whole shares")
+	fs.IntVar(&analysis.Precision, "precision", analysis.Precision, "decimal places prices and amounts are rounded to")
+	fs.Float64Var(&analysis.CommissionPerShare, "commission-per-share", analysis.CommissionPerShare, "commission paid per share on each of entry and exit")
+	fs.Float64Var(&analysis.ProfitMultiplier, "profit-multiplier", analysis.ProfitMultiplier, "fraction of the gap between entry and take profit")
+	fs.Float64Var(&analysis.StopMultiplier, "stop-multiplier", analysis.StopMultiplier, "fraction of the gap between entry and stop loss")
+	profitPercentGiven := false
+	fs.Func("profit-percent", "deprecated, sets both -profit-multiplier and -stop-multiplier, in (0,1]", func(value string) error {
+		percent, err := strconv.ParseFloat(value, 64)
+		if (err!=nil) {
+			return err
+		}
+		if (percent<=0 || percent>1) {
+			return errors.New("must be within (0,1]")
+		}
+		analysis.ProfitMultiplier = percent
+		analysis.StopMultiplier = percent
+		profitPercentGiven = true
+		return nil
+	})
+	fs.StringVar(&analysis.StopMode, "stop-mode", analysis.StopMode, "how the stop loss is placed - gap uses -stop-multiplier, percent uses -stop-percent")
+	fs.Float64Var(&analysis.StopPercent, "stop-percent", analysis.StopPercent, "fraction of the entry price between entry and stop loss with -stop-mode percent")
+	logLevel := fs.String("log-level", "info", "minimum level of the logs written to stderr - debug, info, warn or error")
+	quiet := fs.Bool("quiet", false, "only log errors and print nothing to stdout except -dry-run output, for cron jobs")
+	apiKeyFile := fs.String("api-key-file", "", "file holding the news API key, e.g. one mounted by a secret manager, used instead of $API_KEY")
+	configPath := fs.String("config", "", "path of a JSON config file with default settings, falls back to $STOCK_ANALYSIS_CONFIG")
+	showVersion := fs.Bool("version", false, "print the version, commit and build date, then exit")
+	timings := fs.Bool("timings", false, "log how long each news fetch took and a summary of the slowest")
+	failFast := fs.Bool("fail-fast", false, "abort without writing output on the first news fetch error")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %v:\n", fs.Name())
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\nExit status is 0 on success and 1 if the run fails or the news of any stock could not be fetched,\nin which case the output is still written with the stocks that succeeded unless -fail-fast is set.")
+	}
+	err := fs.Parse(args)
+	if (err!=nil) {
+		return err
+	}
+
+	if (*showVersion) {
+		// printed before any config or environment is looked at, so it works even when they are missing
+		v, c, d := buildInfo()
+		fmt.Fprintf(stdout, "stock-analysis %v (commit %v, built %v)\n", v, c, d)
+		return nil
+	}
+
+	godotenv.Load()
+
+	// flags given on the command line win over the config file, which wins over the defaults
+	if (*configPath=="") {
+		*configPath = os.Getenv("STOCK_ANALYSIS_CONFIG")
+	}
+	if (*configPath!="") {
+		config, err := LoadConfig(*configPath)
+		if (err!=nil) {
+			return err
+		}
+		err = config.Apply(fs)
+		if (err!=nil) {
+			return fmt.Errorf("applying config %v: %w", *configPath, err)
+		}
+	}
+	if (*apiKeyFile!="") {
+		data, err := os.ReadFile(*apiKeyFile)
+		if (err!=nil) {
+			return fmt.Errorf("invalid -api-key-file: %w", err)
+		}
+		key := strings.TrimSpace(string(data))
+		if (key=="") {
+			return fmt.Errorf("invalid -api-key-file %v: file is empty", *apiKeyFile)
+		}
+		os.Setenv("API_KEY", key) // the key from the file wins over one in the environment, .env or config
+	}
+
+	var level slog.Level
+	if (level.UnmarshalText([]byte(*logLevel))!=nil) {
+		return fmt.Errorf("invalid -log-level %q: must be debug, info, warn or error", *logLevel)
+	}
+	report := stdout // where the summary goes, kept apart from stdout so -dry-run output still shows up with -quiet
+	if (*quiet) {
+		if (*confirm) {
+			return errors.New("invalid -quiet: cannot be combined with -confirm")
+		}
+		level = slog.LevelError
+		report = io.Discard
+	}
+	var progress *Progress
+	if (*showProgress && !*quiet && isTerminal(stderr)) {
+		progress = NewProgress(stderr)
+		stderr = progress // logs go through the progress line so they don't interleave with it
+	}
 
-	// filter out unworthy stocks - stocks with difference less than 10%
+	// logs go to stderr so stdout only carries the summary
+	slog.SetDefault(slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level})))
+
+	if (profitPercentGiven) {
+		slog.Warn("-profit-percent is deprecated", "hint", "use -profit-multiplier and -stop-multiplier instead")
+	}
 
-	stocks = slices.DeleteFunc(stocks, func(s Stock) bool {
-		return math.Abs(s.Gap) < 0.1
+	// validate the risk parameters before using them for any calculation
+	if (analysis.AccountBalance<=0) {
+		return fmt.Errorf("invalid -balance %v: must be positive", analysis.AccountBalance)
+	}
+	if (analysis.LossTolerance<=0 || analysis.LossTolerance>1) {
+		return fmt.Errorf("invalid -loss-tolerance %v: must be within (0,1]", analysis.LossTolerance)
+	}
+	if (analysis.ProfitMultiplier<=0) {
+		return fmt.Errorf("invalid -profit-multiplier %v: must be positive", analysis.ProfitMultiplier)
+	}
+	if (analysis.StopMultiplier<=0) {
+		return fmt.Errorf("invalid -stop-multiplier %v: must be positive", analysis.StopMultiplier)
+	}
+	if (!slices.Contains(analysis.StopModes, analysis.StopMode)) {
+		return fmt.Errorf("invalid -stop-mode %q: must be one of %v", analysis.StopMode, strings.Join(analysis.StopModes, ", "))
+	}
+	if (analysis.StopPercent<=0 || analysis.StopPercent>=1) {
+		return fmt.Errorf("invalid -stop-percent %v: must be within (0,1)", analysis.StopPercent)
+	}
+	if (analysis.Precision<0 || analysis.Precision>10) {
+		return fmt.Errorf("invalid -precision %v: must be within [0,10]", analysis.Precision)
+	}
+	if (analysis.CommissionPerShare<0) {
+		return fmt.Errorf("invalid -commission-per-share %v: must not be negative", analysis.CommissionPerShare)
+	}
+	if (analysis.MaxResponseBody<=0) {
+		return fmt.Errorf("invalid -max-response-size %v: must be positive", analysis.MaxResponseBody)
+	}
+	if (utf8.RuneCountInString(*delimiter)!=1 || strings.ContainsAny(*delimiter, "\"\r\n") || *delimiter==string(utf8.RuneError)) {
+		return fmt.Errorf("invalid -delimiter %q: must be a single character other than a quote or newline", *delimiter)
+	}
+	analysis.Delimiter, _ = utf8.DecodeRuneInString(*delimiter)
+	if (*timeout<=0) {
+		return fmt.Errorf("invalid -timeout %v: must be positive", *timeout)
+	}
+	if (*watch<0) {
+		return fmt.Errorf("invalid -watch %v: must not be negative", *watch)
+	}
+	if (*deadline<0) {
+		return fmt.Errorf("invalid -deadline %v: must not be negative", *deadline)
+	}
+	if (*newsSince<0) {
+		return fmt.Errorf("invalid -news-since %v: must not be negative", *newsSince)
+	}
+	if (*maxNewsAge<0) {
+		return fmt.Errorf("invalid -max-news-age %v: must not be negative", *maxNewsAge)
+	}
+	if (*sentimentOverride<0 || *sentimentOverride>1) {
+		return fmt.Errorf("invalid -sentiment-override %v: must be within [0,1]", *sentimentOverride)
+	}
+	if (*requireNews && *noNews) {
+		return errors.New("invalid -require-news: cannot be combined with -no-news")
+	}
+	if (*maxNewsAge>0 && *noNews) {
+		return errors.New("invalid -max-news-age: needs news, cannot be combined with -no-news")
+	}
+	if (!slices.Contains(analysis.DupPolicies, *dupPolicy)) {
+		return fmt.Errorf("invalid -dup-policy %q: must be one of %v", *dupPolicy, strings.Join(analysis.DupPolicies, ", "))
+	}
+	if (!slices.Contains(analysis.SortKeys, *sortKey)) {
+		return fmt.Errorf("invalid -sort %q: must be one of %v", *sortKey, strings.Join(analysis.SortKeys, ", "))
+	}
+	descending := *sortKey==analysis.SortProfit || *sortKey==analysis.SortGap // biggest first, tickers alphabetically
+	fs.Visit(func(f *flag.Flag) {
+		if (f.Name=="sort-desc") {
+			descending = *sortDesc
+		}
 	})
+	if (*top<0) {
+		return fmt.Errorf("invalid -top %v: must not be negative", *top)
+	}
+	if (analysis.MaxRetries<0) {
+		return fmt.Errorf("invalid -max-retries %v: must not be negative", analysis.MaxRetries)
+	}
+	if (analysis.RetryBaseDelay<0) {
+		return fmt.Errorf("invalid -retry-delay %v: must not be negative", analysis.RetryBaseDelay)
+	}
+	if (!slices.Contains(analysis.Formats, *format)) {
+		return fmt.Errorf("invalid -format %q: must be one of %v", *format, strings.Join(analysis.Formats, ", "))
+	}
+	if (analysis.GapUnit!=analysis.GapFraction && analysis.GapUnit!=analysis.GapPercent) {
+		return fmt.Errorf("invalid -gap-unit %q: must be %v or %v", analysis.GapUnit, analysis.GapFraction, analysis.GapPercent)
+	}
+	if (*splitOutput && *format!=analysis.FormatJSON) {
+		return fmt.Errorf("invalid -format %q: -split-output only writes json", *format)
+	}
+	if (analysis.MaxOpenFiles<1) {
+		return fmt.Errorf("invalid -max-open-files %v: must be at least 1", analysis.MaxOpenFiles)
+	}
+	if (*appendOutput && (*format!=analysis.FormatJSON || *splitOutput || *gzipOutput)) {
+		return errors.New("invalid -append: only works with an uncompressed json -output file")
+	}
+	if (*stateFile!="" && !*appendOutput) {
+		return errors.New("invalid -state-file: needs -append, or the selections of the tickers it skips would be lost from the output")
+	}
+	if (*splitOutput && *gzipOutput) {
+		return errors.New("invalid -gzip: cannot be combined with -split-output")
+	}
+	if (!slices.Contains(analysis.Allocations, *allocation)) {
+		return fmt.Errorf("invalid -allocation %q: must be one of %v", *allocation, strings.Join(analysis.Allocations, ", "))
+	}
+	if (*minPrice<0) {
+		return fmt.Errorf("invalid -min-price %v: must not be negative", *minPrice)
+	}
+	if (*maxPrice<0 || (*maxPrice>0 && *maxPrice<*minPrice)) {
+		return fmt.Errorf("invalid -max-price %v: must not be negative or below -min-price", *maxPrice)
+	}
+	if (*minGap<0) {
+		return fmt.Errorf("invalid -min-gap %v: must not be negative", *minGap)
+	}
+	if (*minProfit<0) {
+		return fmt.Errorf("invalid -min-profit %v: must not be negative", *minProfit)
+	}
+	if (*maxGap<0) {
+		return fmt.Errorf("invalid -max-gap %v: must not be negative", *maxGap)
+	}
+	if (*maxArticles<0) {
+		return fmt.Errorf("invalid -max-articles %v: must not be negative", *maxArticles)
+	}
+	if (*concurrency<1) {
+		return fmt.Errorf("invalid -concurrency %v: must be at least 1", *concurrency)
+	}
+	if (analysis.MaxPositionValue<0) {
+		return fmt.Errorf("invalid -max-position-value %v: must not be negative", analysis.MaxPositionValue)
+	}
+	if (analysis.BuyingPower<0) {
+		return fmt.Errorf("invalid -buying-power %v: must not be negative", analysis.BuyingPower)
+	}
+	analysis.MaxLossPerTrade = analysis.AccountBalance * analysis.LossTolerance // recompute as the flags may have changed balance and tolerance
+	if (analysis.BuyingPower==0) {
+		analysis.BuyingPower = analysis.AccountBalance
+	}
+	if (analysis.MaxPositionValue==0) {
+		analysis.MaxPositionValue = analysis.BuyingPower
+	}
+
+	var provider analysis.NewsProvider
+	if (*mockNews) {
+		*providerName = analysis.ProviderMock
+	}
+	if (!*noNews) {
+		client := analysis.NewHTTPClient()
+		if (level<=slog.LevelDebug) {
+			client.Transport = &analysis.LoggingTransport{Base: client.Transport, Redact: []string{os.Getenv("API_KEY_HEADER")}}
+		}
+		provider, err = analysis.NewProvider(*providerName, analysis.ProviderOptions{
+			Client: client,
+			UserAgent: *userAgent,
+			Params: newsParams.values,
+		})
+		if (err!=nil) {
+			return err
+		}
+		if (!*noCache && *cacheTTL>0 && *providerName!=analysis.ProviderMock) { // made-up articles must never be served to a real run
+			cacheDir, err := os.UserCacheDir()
+			if (err!=nil) {
+				return fmt.Errorf("locating cache directory: %w", err)
+			}
+			provider = &analysis.CachedProvider{
+				Provider: provider,
+				Dir: filepath.Join(cacheDir, "stock-analysis", "news"),
+				TTL: *cacheTTL,
+				Key: *providerName+" "+os.Getenv("SEEKING_ALPHA_URL")+"?"+newsParams.values.Encode(), // changing the endpoint or -news-params fetches afresh
+			}
+		}
+	}
+
+	// one pass over the input: load, size, fetch news and write the output - repeated with -watch
+	analyse := func() error {
+		stocks, skipped, err := analysis.LoadAll(inputPaths.values, *inputFormat)
+		if (err!=nil) {
+			return err
+		}
+		if (len(skipped)>0) {
+			for _, row := range skipped {
+				slog.Debug("skipped row", "path", row.Path, "line", row.LineNumber, "raw", row.Raw, "reason", row.Reason)
+			}
+			slog.Warn(fmt.Sprintf("skipped %d of %d rows", len(skipped), len(stocks)+len(skipped)), "hint", "run with -log-level debug for details")
+		}
+		stocks, err = analysis.DedupStocks(stocks, *dupPolicy) // a ticker in several files is only analysed once
+		if (err!=nil) {
+			return err
+		}
+		only, err := analysis.TickerSet(onlyTickers.values)
+		if (err!=nil) {
+			return fmt.Errorf("invalid -only: %w", err)
+		}
+		exclude, err := analysis.TickerSet(excludeTickers.values)
+		if (err!=nil) {
+			return fmt.Errorf("invalid -exclude: %w", err)
+		}
+		stocks = analysis.FilterByTicker(stocks, only, exclude)
+
+		if (*validateOnly) {
+			// flags, config, environment and input have all been checked by now, without any request being sent
+			if (len(skipped)>0) {
+				row := skipped[0]
+				return fmt.Errorf("%d invalid rows, the first in %v line %d: %v", len(skipped), row.Path, row.LineNumber, row.Reason)
+			}
+			fmt.Fprintln(stdout, "OK")
+			return nil
+		}
 
-	url = os.Getenv("SEEKING_ALPHA_URL")
-	apiKeyHeader = os.Getenv("API_KEY_HEADER")
-	apiKey = os.Getenv("API_KEY")
+		// filter out unworthy stocks - stocks with difference less than -min-gap (10% by default)
 
-	var selections []Selection
+		stats := analysis.GapStats(stocks)
+		slog.Info("gaps across the watchlist", "stocks", stats.Count, "min", fmt.Sprintf("%.4f", stats.Min), "max", fmt.Sprintf("%.4f", stats.Max), "mean", fmt.Sprintf("%.4f", stats.Mean))
+		if (*minPrice>0 || *maxPrice>0) {
+			before := len(stocks)
+			stocks = analysis.FilterByPrice(stocks, *minPrice, *maxPrice)
+			slog.Info("filtered out stocks outside the price range", "count", before-len(stocks), "min_price", *minPrice, "max_price", *maxPrice)
+		}
+		if (*noFilter) {
+			slog.Info("minimum gap filter disabled, including every stock within -max-gap")
+		} else {
+			stocks = analysis.FilterByGap(stocks, *minGap)
+		}
+		stocks = analysis.FilterByMaxGap(stocks, *maxGap) // bad data is dropped even with -no-filter
+		slog.Info("filtered stocks by gap", "included", len(stocks), "of", stats.Count)
 
-	// var wg sync.WaitGroup
+		var state analysis.State
+		if (*stateFile!="") {
+			state, err = analysis.LoadState(*stateFile)
+			if (err!=nil) {
+				return fmt.Errorf("invalid -state-file: %w", err)
+			}
+			if (!*force) {
+				before := len(stocks)
+				stocks = slices.DeleteFunc(stocks, func(s analysis.Stock) bool {
+					return state.Done(s.Ticker, time.Now())
+				})
+				if (before>len(stocks)) {
+					slog.Info("skipping tickers already analysed today", "count", before-len(stocks), "hint", "run with -force to analyse them again")
+				}
+			}
+		}
+		if (len(stocks)==0) {
+			slog.Info("no stocks left to analyse, writing empty output") // nothing to fetch, the rest of the run just writes an empty list
+		}
 
-	selectionChan := make(chan Selection, len(stocks))
-	for _, stock := range stocks {
-		// wg.Add(1)
-		go func(s Stock, selected chan<-Selection) {
-			// defer wg.Done()
-			position := Calculate(s.Gap, s.OpeningPrice)
-			articles, err := FetchNews(s.Ticker)
+		// size a position for every stock up front, skipping the ones with no sensible trade
+		var candidates []analysis.Selection
+		budgets := analysis.RiskBudgets(stocks, analysis.MaxLossPerTrade)
+		for i, stock := range stocks {
+			maxLoss := analysis.MaxLossPerTrade
+			if (*weightByGap) {
+				maxLoss = budgets[i] // the trades share one trade's worth of risk, weighted towards the bigger gaps
+			}
+			position, err := analysis.CalculateWithMaxLoss(stock.Gap, stock.OpeningPrice, maxLoss)
 			if (err!=nil) {
-				fmt.Printf("error loading news about %v, %v\n", s.Ticker, err)
+				slog.Warn("skipping stock with no valid position", "ticker", stock.Ticker, "err", err)
+				continue
 			}
-			fmt.Printf("Found %d articles about %v\n", len(articles), s.Ticker)
-			sel := Selection{
-				Ticker: s.Ticker,
+			candidates = append(candidates, analysis.Selection{
+				Ticker: stock.Ticker,
+				Gap: stock.Gap,
+				RawGap: stock.RawGap,
+				OpeningPrice: stock.OpeningPrice,
 				Position: position,
-				Articles: articles,
+			})
+		}
+
+		if (*minProfit>0) {
+			before := len(candidates)
+			candidates = analysis.FilterByProfit(candidates, *minProfit)
+			slog.Info("filtered out selections below the minimum profit", "count", before-len(candidates), "min_profit", *minProfit)
+		}
+
+		// fit the positions within the buying power before fetching, so no requests are spent on dropped stocks
+		candidates = analysis.Allocate(candidates, *allocation, analysis.BuyingPower)
+
+		if (progress!=nil && !*noNews) {
+			progress.Start(len(candidates), *concurrency)
+		}
+
+		// the -deadline for the whole run, which stops the remaining fetches like an interrupt does
+		root := context.Background()
+		if (*deadline>0) {
+			var cancelDeadline context.CancelFunc
+			root, cancelDeadline = context.WithTimeout(root, *deadline)
+			defer cancelDeadline()
+		}
+
+		// SIGINT or SIGTERM cancels the remaining fetches, the completed ones are still written
+		sigCtx, stop := signal.NotifyContext(root, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-sigCtx.Done()
+			stop() // a second signal kills the process as usual
+		}()
+
+		ctx, cancel := context.WithCancel(sigCtx) // cancelled to abort the remaining fetches with -fail-fast
+		defer cancel()
+
+		var failMu sync.Mutex
+		var failed []string // tickers whose news could not be fetched
+		var failErr error // first fetch error, which aborts the run with -fail-fast
+		var unfinished []string // tickers whose fetch was cut short by an interrupt or the -deadline
+		var fetchTimes []fetchTiming // with -timings
+
+		sem := make(chan struct{}, *concurrency) // holds a token for every request in flight
+		selections := fanIn(candidates, func(sel analysis.Selection) (analysis.Selection, bool) {
+			if (*noNews) {
+				return sel, true
 			}
-			selected<-sel
-			// selections = append(selections, sel)
-		} (stock, selectionChan) // calling the above anonymous function on 'stock'
-	}
+			sem<-struct{}{} // blocks while the limit of requests is in flight
+			fetchCtx, cancelFetch := context.WithTimeout(ctx, *timeout)
+			start := time.Now()
+			articles, err := provider.Fetch(fetchCtx, sel.Ticker)
+			elapsed := time.Since(start)
+			cancelFetch()
+			<-sem
+			if (*timings) {
+				slog.Info("fetched news", "ticker", sel.Ticker, "duration", elapsed)
+				failMu.Lock()
+				fetchTimes = append(fetchTimes, fetchTiming{sel.Ticker, elapsed})
+				failMu.Unlock()
+			}
+			if (err!=nil && sigCtx.Err()!=nil) {
+				failMu.Lock()
+				unfinished = append(unfinished, sel.Ticker)
+				failMu.Unlock()
+				return sel, false // interrupted before the news arrived, leave the stock out of the partial results
+			}
+			if (err!=nil) {
+				slog.Warn("error loading news", "ticker", sel.Ticker, "err", err)
+				failMu.Lock()
+				failed = append(failed, sel.Ticker)
+				if (*failFast && failErr==nil) {
+					failErr = fmt.Errorf("error loading news about %v: %w", sel.Ticker, err)
+					cancel()
+				}
+				failMu.Unlock()
+			}
+			if (*newsSince>0) {
+				articles = analysis.FilterRecent(articles, time.Now().Add(-*newsSince))
+			}
+			sel.Articles = analysis.LatestArticles(articles, *maxArticles)
+			sel.Sentiment = analysis.ScoreSentiment(sel.Articles)
+			sel.LatestNews = analysis.LatestPublished(sel.Articles)
+			sel.Warning = analysis.SentimentWarning(sel, *sentimentOverride)
+			if (sel.Warning!="") {
+				slog.Warn("news conflicts with the trade", "ticker", sel.Ticker, "warning", sel.Warning)
+			}
+			slog.Info("found articles", "ticker", sel.Ticker, "count", len(sel.Articles))
+			if (progress!=nil) {
+				progress.Increment(elapsed)
+			}
+			return sel, true
+		})
+		if (progress!=nil) {
+			progress.Finish()
+		}
+		if (*timings) {
+			logTimings(fetchTimes)
+		}
+		if (failErr!=nil) {
+			return failErr // nothing is written when failing fast
+		}
 
-	// wg.Wait()
+		fetched := len(selections) // before -top trims the list
+		var processed []string // tickers to record in the state file, failed fetches are left to be retried
+		for _, sel := range selections {
+			if (!slices.Contains(failed, sel.Ticker)) {
+				processed = append(processed, sel.Ticker)
+			}
+		}
+		if (*requireNews) {
+			before := len(selections)
+			selections = analysis.FilterByNews(selections)
+			slog.Info("dropped selections without news", "count", before-len(selections))
+		}
+		if (*maxNewsAge>0) {
+			before := len(selections)
+			selections = analysis.FilterByNewsAge(selections, time.Now().Add(-*maxNewsAge))
+			slog.Info("filtered out selections without recent news", "count", before-len(selections), "max_news_age", *maxNewsAge)
+		}
+		selections = analysis.TopSelections(selections, *top) // sorts too, so the output is the same whatever order the fetches finished in
+		if (*appendOutput) {
+			existing, err := analysis.ReadSelections(*outputPath)
+			if (err!=nil) {
+				return fmt.Errorf("invalid -append: %w", err)
+			}
+			selections = analysis.MergeSelections(existing, selections)
+		}
+		if (*sortKey==analysis.SortNone) {
+			// back in the order of the input, the order the fetches finished in changes from run to run
+			slices.SortStableFunc(selections, func(a, b analysis.Selection) int {
+				return cmp.Compare(inputOrder(candidates, a.Ticker), inputOrder(candidates, b.Ticker))
+			})
+		}
+		analysis.SortSelectionsBy(selections, *sortKey, descending)
 
-	for sel := range selectionChan {
-		selections = append(selections, sel)
-		if (len(selections)==len(stocks)) {
-			close(selectionChan)
+		outputFile := *outputPath
+		interrupted := sigCtx.Err()!=nil
+		reason := "interrupted"
+		if (errors.Is(sigCtx.Err(), context.DeadlineExceeded)) {
+			reason = "deadline exceeded"
+		}
+		if (interrupted) {
+			outputFile = partialPath(*outputPath) // don't pass off partial results as a complete run
+			slices.Sort(unfinished)
+			slog.Warn(reason+", writing partial results", "completed", fetched, "total", len(candidates), "unfinished", unfinished)
+		}
+		if (*gzipOutput) {
+			outputFile += ".gz"
 		}
-	}
 
-	outputPath := "./opg.json"
-	err = Deliver(outputPath, selections)
-	if (err!=nil) {
-		fmt.Printf("Error writing output: %v\n", err)
-		return
+		if (*confirm && !*dryRun) {
+			analysis.PrintSummary(selections, stdout) // shown before asking, so the user knows what they are confirming
+			if (!askYesNo(stdin, stdout, fmt.Sprintf("Write %d selections to %v? [y/N] ", len(selections), outputFile))) {
+				slog.Info("output not written")
+				return nil
+			}
+		}
+
+		if (*dryRun) {
+			// preview what would have been written without touching the output file
+			err = analysis.Encode(stdout, *format, selections)
+			if (err!=nil) {
+				return err
+			}
+		} else {
+			if (*splitOutput) {
+				err = analysis.DeliverSplit(outputFile, selections)
+			} else {
+				err = analysis.Deliver(outputFile, *format, selections, *gzipOutput)
+			}
+			if (err!=nil) {
+				return fmt.Errorf("error writing output: %w", err)
+			}
+			slog.Info("finished writing output", "path", outputFile)
+			if (*stateFile!="") {
+				state.Mark(processed, time.Now())
+				err = analysis.SaveState(*stateFile, state)
+				if (err!=nil) {
+					return fmt.Errorf("error saving state: %w", err)
+				}
+			}
+		}
+		if (!*confirm || *dryRun) {
+			analysis.PrintSummary(selections, report)
+		}
+
+		if (interrupted) {
+			return fmt.Errorf("%v after fetching news for %d of %d stocks, unfinished: %v", reason, fetched, len(candidates), strings.Join(unfinished, ", "))
+		}
+
+		if (len(failed)>0) {
+			slices.Sort(failed)
+			if (*watch==0) { // with -watch the next pass runs regardless
+				fmt.Fprintf(report, "\nNews could not be fetched for %d of %d stocks, exiting with status 1.\n", len(failed), len(candidates))
+			}
+			return fmt.Errorf("news could not be fetched for %v", strings.Join(failed, ", "))
+		}
+		return nil
 	}
-	fmt.Printf("Finished writing output to %v\n", outputPath)
 
+	if (*watch==0 || *validateOnly) {
+		return analyse()
+	}
+	// SIGINT or SIGTERM stops watching, cutting short a pass in progress the same way as without -watch
+	watchCtx, stopWatch := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopWatch()
+	return watchLoop(watchCtx, *watch, analyse)
 }
\ No newline at end of file
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ramananubhaw/Stock-Analysis-CLI-in-Go/analysis"
+)
+
+// wraps MockProvider, sleeping before the news of the slow tickers and failing the news of the failing ones
+type flakyProvider struct {
+	analysis.MockProvider
+	slow map[string]bool
+	failing map[string]bool
+}
+
+func (p flakyProvider) Fetch(ctx context.Context, ticker string) ([]analysis.Article, error) {
+	if (p.slow[ticker]) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if (p.failing[ticker]) {
+		return nil, errors.New("fetch failed")
+	}
+	return p.MockProvider.Fetch(ctx, ticker)
+}
+
+func TestFanIn(t *testing.T) {
+	tests := []struct {
+		name string
+		tickers int
+		slow map[string]bool
+		failing map[string]bool
+		want int
+	}{
+		{name: "no items", tickers: 0},
+		{name: "all succeed", tickers: 20, want: 20},
+		{name: "slow and failing", tickers: 20, slow: map[string]bool{"T0": true, "T5": true, "T7": true}, failing: map[string]bool{"T5": true, "T9": true}, want: 18},
+		{name: "all fail", tickers: 5, failing: map[string]bool{"T0": true, "T1": true, "T2": true, "T3": true, "T4": true}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := flakyProvider{slow: tt.slow, failing: tt.failing}
+			var items []analysis.Selection
+			for i := range tt.tickers {
+				items = append(items, analysis.Selection{Ticker: fmt.Sprintf("T%d", i)})
+			}
+
+			done := make(chan []analysis.Selection)
+			go func() {
+				done<-fanIn(items, func(sel analysis.Selection) (analysis.Selection, bool) {
+					articles, err := provider.Fetch(context.Background(), sel.Ticker)
+					if (err!=nil) {
+						return sel, false
+					}
+					sel.Articles = articles
+					return sel, true
+				})
+			}()
+
+			select {
+			case got := <-done:
+				if (len(got)!=tt.want) {
+					t.Errorf("got %d results, want %d", len(got), tt.want)
+				}
+				for _, sel := range got {
+					if (tt.failing[sel.Ticker] || len(sel.Articles)==0) {
+						t.Errorf("unexpected result %+v", sel)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("fanIn did not return, deadlocked")
+			}
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// publish times of the made-up articles change every hour, so they are masked before comparing
+var timestamps = regexp.MustCompile(`"\d{4}-\d{2}-\d{2}T[^"]*"`)
+
+func TestRunGolden(t *testing.T) {
+	t.Setenv("STOCK_ANALYSIS_CONFIG", "") // a config in the environment would change the output
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "json", args: []string{"-format", "json", "-max-articles", "2"}},
+		{name: "input-order", args: []string{"-format", "csv", "-sort", "none"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// several runs must give the same output, whatever order the fetches finish in
+			var outputs []string
+			for range 3 {
+				var stdout bytes.Buffer
+				args := append([]string{"-input", "testdata/golden.csv", "-provider", analysis.ProviderMock, "-dry-run", "-quiet"}, tt.args...)
+				err := run(args, strings.NewReader(""), &stdout, io.Discard)
+				if (err!=nil) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				outputs = append(outputs, timestamps.ReplaceAllString(stdout.String(), `"TIMESTAMP"`))
+			}
+			if (outputs[0]!=outputs[1] || outputs[1]!=outputs[2]) {
+				t.Fatalf("output changed between runs:\n%v\n%v\n%v", outputs[0], outputs[1], outputs[2])
+			}
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if (*update) {
+				err := os.WriteFile(golden, []byte(outputs[0]), 0o644)
+				if (err!=nil) {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if (err!=nil) {
+				t.Fatal(err)
+			}
+			if (outputs[0]!=string(want)) {
+				t.Errorf("output differs from %v, run go test -update if the change is intended:\ngot\n%v\nwant\n%v", golden, outputs[0], want)
+			}
+		})
+	}
+}
+
+func TestLogTimings(t *testing.T) {
+	defer func(logger *slog.Logger) { slog.SetDefault(logger) }(slog.Default())
+
+	ms := time.Millisecond
+	var twenty []fetchTiming
+	for _, i := range []int{7, 20, 1, 13, 4, 18, 10, 2, 16, 5, 19, 11, 3, 14, 8, 17, 6, 12, 9, 15} {
+		twenty = append(twenty, fetchTiming{fmt.Sprintf("T%d", i), time.Duration(i) * ms})
+	}
+	tests := []struct {
+		name string
+		timings []fetchTiming
+		want string // logged fields, none when empty
+	}{
+		{name: "no fetches"},
+		{name: "one fetch", timings: []fetchTiming{{"A", 5 * ms}}, want: `fetches=1 p50=5ms p95=5ms slowest="A (5ms)"`},
+		{name: "nearest rank", timings: []fetchTiming{{"A", 40 * ms}, {"B", 10 * ms}, {"C", 30 * ms}, {"D", 20 * ms}}, want: `fetches=4 p50=20ms p95=40ms slowest="A (40ms), C (30ms), D (20ms)"`},
+		{name: "twenty fetches", timings: twenty, want: `fetches=20 p50=10ms p95=19ms slowest="T20 (20ms), T19 (19ms), T18 (18ms)"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+			logTimings(tt.timings)
+			if (tt.want=="") {
+				if (logs.Len()>0) {
+					t.Errorf("got %q, want nothing logged", logs.String())
+				}
+				return
+			}
+			if (!strings.Contains(logs.String(), tt.want)) {
+				t.Errorf("got %q, want it to contain %q", logs.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRunTimings(t *testing.T) {
+	delays := map[string]time.Duration{"NVDA": 300 * time.Millisecond, "AAPL": 150 * time.Millisecond}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delays[path.Base(r.URL.Path)])
+		fmt.Fprint(w, `{"data": []}`)
+	}))
+	defer server.Close()
+	t.Setenv("STOCK_ANALYSIS_CONFIG", "")
+	t.Setenv("SEEKING_ALPHA_URL", server.URL+"/news/")
+	t.Setenv("API_KEY_HEADER", "X-Key")
+	t.Setenv("API_KEY", "secret")
+
+	var stderr bytes.Buffer
+	args := []string{"-input", "testdata/golden.csv", "-provider", analysis.ProviderSeekingAlpha, "-no-cache", "-timings", "-dry-run"}
+	err := run(args, strings.NewReader(""), io.Discard, &stderr)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := regexp.MustCompile(`msg="fetch timings" fetches=3 .*slowest="NVDA \([^)]+\), AAPL \([^)]+\), MSFT \([^)]+\)"`)
+	if (!want.MatchString(stderr.String())) {
+		t.Errorf("got logs\n%v\nwant a line matching %v", stderr.String(), want)
+	}
+}
+
+func TestETA(t *testing.T) {
+	repeat := func(d time.Duration, n int) []time.Duration {
+		return slices.Repeat([]time.Duration{d}, n)
+	}
+	tests := []struct {
+		name string
+		durations []time.Duration // completed fetches, in order
+		remaining int
+		workers int
+		want time.Duration
+	}{
+		{name: "empty window", remaining: 10, workers: 2, want: 0},
+		{name: "nothing remaining", durations: repeat(time.Second, 3), remaining: 0, workers: 2, want: 0},
+		{name: "fewer remaining than workers", durations: []time.Duration{time.Second, 3 * time.Second}, remaining: 3, workers: 4, want: 2 * time.Second},
+		{name: "last batch partly filled", durations: repeat(2*time.Second, 4), remaining: 5, workers: 2, want: 6 * time.Second},
+		{name: "older fetches leave the window", durations: append(repeat(10*time.Second, etaWindow), repeat(time.Second, etaWindow)...), remaining: 4, workers: 1, want: 4 * time.Second},
+		{name: "window partly refreshed", durations: append(repeat(5*time.Second, etaWindow), repeat(time.Second, etaWindow/2)...), remaining: 1, workers: 1, want: 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewProgress(io.Discard)
+			for _, d := range tt.durations {
+				p.Increment(d)
+			}
+			if (len(p.recent)>etaWindow) {
+				t.Errorf("got %d durations in the window, want at most %d", len(p.recent), etaWindow)
+			}
+			got := eta(p.recent, tt.remaining, tt.workers)
+			if (got!=tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchLoop(t *testing.T) {
+	defer func(logger *slog.Logger) { slog.SetDefault(logger) }(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	errBad := errors.New("bad pass")
+	errCut := errors.New("cut short")
+	tests := []struct {
+		name string
+		passErrs []error // returned by each pass in turn
+		cancelAfter bool // cancel once the last pass has returned instead of during it
+		wantErr error
+	}{
+		{name: "cancelled during a pass", passErrs: []error{nil, errCut}, wantErr: errCut},
+		{name: "failed pass keeps watching", passErrs: []error{errBad, nil, nil}},
+		{name: "cancelled between passes", passErrs: []error{nil, nil}, cancelAfter: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			runs := 0
+			err := watchLoop(ctx, 10*time.Millisecond, func() error {
+				runs++
+				if (runs>=len(tt.passErrs)) {
+					if (tt.cancelAfter) {
+						time.AfterFunc(time.Millisecond, cancel) // lands while the loop waits for the next pass
+					} else {
+						cancel()
+					}
+				}
+				return tt.passErrs[min(runs, len(tt.passErrs))-1]
+			})
+			if (runs!=len(tt.passErrs)) {
+				t.Errorf("got %d passes, want %d", runs, len(tt.passErrs))
+			}
+			if (!errors.Is(err, tt.wantErr)) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunStateFile(t *testing.T) {
+	t.Setenv("STOCK_ANALYSIS_CONFIG", "")
+	dir := t.TempDir()
+	output := filepath.Join(dir, "opg.json")
+	state := filepath.Join(dir, "state.json")
+	var logs bytes.Buffer
+	analyse := func(extra ...string) ([]string, error) {
+		logs.Reset()
+		args := append([]string{"-input", "testdata/golden.csv", "-provider", analysis.ProviderMock, "-output", output, "-state-file", state}, extra...)
+		err := run(args, strings.NewReader(""), io.Discard, &logs)
+		if (err!=nil) {
+			return nil, err
+		}
+		selections, err := analysis.ReadSelections(output)
+		var tickers []string
+		for _, sel := range selections {
+			tickers = append(tickers, sel.Ticker)
+		}
+		slices.Sort(tickers)
+		return tickers, err
+	}
+
+	_, err := analyse()
+	if (err==nil) {
+		t.Fatal("want an error for -state-file without -append")
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+		wantSkipped bool
+	}{
+		{name: "first run", args: []string{"-append", "-only", "AAPL"}, want: []string{"AAPL"}},
+		{name: "skips tickers done today but keeps their selections", args: []string{"-append", "-only", "AAPL,MSFT"}, want: []string{"AAPL", "MSFT"}, wantSkipped: true},
+		{name: "force analyses them again", args: []string{"-append", "-force"}, want: []string{"AAPL", "MSFT", "NVDA"}},
+	}
+	for _, tt := range tests {
+		got, err := analyse(tt.args...)
+		if (err!=nil) {
+			t.Fatalf("%v: unexpected error: %v", tt.name, err)
+		}
+		if (!slices.Equal(got, tt.want)) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+		skipped := strings.Contains(logs.String(), "skipping tickers already analysed today")
+		if (skipped!=tt.wantSkipped) {
+			t.Errorf("%v: got skipped %v, want %v", tt.name, skipped, tt.wantSkipped)
+		}
+	}
+}
+
+// runs the CLI with args and no config from the environment, returning what it wrote to stdout and stderr
+func runCLI(t *testing.T, args ...string) (string, string, error) {
+	t.Helper()
+	t.Setenv("STOCK_ANALYSIS_CONFIG", "")
+	var stdout, stderr bytes.Buffer
+	err := run(args, strings.NewReader(""), &stdout, &stderr)
+	return stdout.String(), stderr.String(), err
+}
+
+// returns the tickers of csv output in order
+func csvTickers(output string) []string {
+	var tickers []string
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n")[1:] {
+		ticker, _, _ := strings.Cut(line, ",")
+		tickers = append(tickers, ticker)
+	}
+	return tickers
+}
+
+func TestRunSortNone(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "input order", want: []string{"MSFT", "AAPL", "NVDA"}},
+		// drops AAPL, the least profitable, without reordering the rest
+		{name: "after dropping allocations", args: []string{"-allocation", analysis.AllocateDrop, "-buying-power", "25000", "-max-position-value", "10000"}, want: []string{"MSFT", "NVDA"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-input", "testdata/golden.csv", "-provider", analysis.ProviderMock, "-dry-run", "-quiet", "-format", "csv", "-sort", "none"}, tt.args...)
+			stdout, _, err := runCLI(t, args...)
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := csvTickers(stdout)
+			if (!slices.Equal(got, tt.want)) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgressRestart(t *testing.T) {
+	var out bytes.Buffer
+	p := NewProgress(&out)
+	p.Start(4, 1)
+	for range 4 {
+		p.Increment(time.Minute)
+	}
+	p.Finish()
+
+	out.Reset()
+	p.Start(2, 1) // the next -watch pass
+	if (!strings.Contains(out.String(), "0/2 done") || strings.Contains(out.String(), "ETA")) {
+		t.Errorf("got %q, want the counter to start again at 0/2 with no ETA", out.String())
+	}
+	p.Increment(time.Second)
+	if (!strings.Contains(out.String(), "1/2 done, ETA ~1s")) {
+		t.Errorf("got %q, want 1/2 done with an ETA from this pass only", out.String())
+	}
+}
+
+func TestRunProfitPercent(t *testing.T) {
+	defer func(profit, stop float64) { analysis.ProfitMultiplier, analysis.StopMultiplier = profit, stop }(analysis.ProfitMultiplier, analysis.StopMultiplier)
+
+	_, stderr, err := runCLI(t, "-input", "testdata/valid.csv", "-no-news", "-validate-only", "-profit-percent", "0.6")
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if (analysis.ProfitMultiplier!=0.6 || analysis.StopMultiplier!=0.6) {
+		t.Errorf("got multipliers %v and %v, want both 0.6", analysis.ProfitMultiplier, analysis.StopMultiplier)
+	}
+	if (!strings.Contains(stderr, "-profit-percent is deprecated")) {
+		t.Errorf("got logs %q, want a deprecation warning", stderr)
+	}
+
+	_, _, err = runCLI(t, "-input", "testdata/valid.csv", "-no-news", "-validate-only", "-profit-percent", "1.5")
+	if (err==nil) {
+		t.Error("want an error for -profit-percent outside (0,1]")
+	}
+}
+
+func TestRunConcurrency(t *testing.T) {
+	var inFlight, most atomic.Int32
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := most.Load()
+			if (n<=m || most.CompareAndSwap(m, n)) {
+				break
+			}
+		}
+		time.Sleep(50*time.Millisecond) // long enough for the other fetches to pile up
+		fmt.Fprint(w, `{"data": []}`)
+	}))
+	defer server.Close()
+	t.Setenv("SEEKING_ALPHA_URL", server.URL+"/news/")
+	t.Setenv("API_KEY_HEADER", "X-Key")
+	t.Setenv("API_KEY", "secret")
+
+	input := "ticker,gap,opening\n"
+	for _, ticker := range []string{"A", "B", "C", "D", "E", "F", "G", "H"} {
+		input += ticker+",0.2,50\n"
+	}
+	path := filepath.Join(t.TempDir(), "stocks.csv")
+	err := os.WriteFile(path, []byte(input), 0o644)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+
+	_, _, err = runCLI(t, "-input", path, "-provider", analysis.ProviderSeekingAlpha, "-concurrency", "2", "-no-cache", "-dry-run", "-quiet")
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if (requests.Load()!=8) {
+		t.Errorf("got %d requests, want one for each of the 8 tickers", requests.Load())
+	}
+	if (most.Load()>2) {
+		t.Errorf("got %d requests in flight at once, want at most 2", most.Load())
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	// set first so Apply's changes to the environment are undone after the test
+	t.Setenv("API_KEY", "from-env")
+	t.Setenv("API_KEY_HEADER", "")
+	t.Setenv("SEEKING_ALPHA_URL", "")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	err := os.WriteFile(path, []byte(`{"balance": 50000, "lossTolerance": 0.02, "minGap": 0.1, "apiKey": "from-config", "apiKeyHeader": "X-Config"}`), 0o644)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	balance := fs.Float64("balance", 10000, "")
+	lossTolerance := fs.Float64("loss-tolerance", 0.01, "")
+	profitMultiplier := fs.Float64("profit-multiplier", 0.8, "")
+	stopMultiplier := fs.Float64("stop-multiplier", 0.8, "")
+	minGap := fs.Float64("min-gap", 0.05, "")
+	err = fs.Parse([]string{"-balance", "20000", "-min-gap", "0.05"})
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	err = config.Apply(fs)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	flags := []struct {
+		name string
+		got float64
+		want float64
+	}{
+		{name: "balance from the flag", got: *balance, want: 20000},
+		{name: "min-gap from the flag, even at its default", got: *minGap, want: 0.05},
+		{name: "loss-tolerance from the config", got: *lossTolerance, want: 0.02},
+		{name: "profit-multiplier left at its default", got: *profitMultiplier, want: 0.8},
+		{name: "stop-multiplier left at its default", got: *stopMultiplier, want: 0.8},
+	}
+	for _, f := range flags {
+		if (f.got!=f.want) {
+			t.Errorf("%v: got %v, want %v", f.name, f.got, f.want)
+		}
+	}
+
+	env := []struct {
+		key string
+		want string
+	}{
+		{key: "API_KEY", want: "from-env"}, // already in the environment
+		{key: "API_KEY_HEADER", want: "X-Config"},
+		{key: "SEEKING_ALPHA_URL", want: ""}, // in neither
+	}
+	for _, e := range env {
+		if (os.Getenv(e.key)!=e.want) {
+			t.Errorf("%v: got %q, want %q", e.key, os.Getenv(e.key), e.want)
+		}
+	}
+
+	misspelt := filepath.Join(dir, "misspelt.json")
+	err = os.WriteFile(misspelt, []byte(`{"balanse": 50000}`), 0o644)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	_, err = LoadConfig(misspelt)
+	if (err==nil || !strings.Contains(err.Error(), "balanse")) {
+		t.Errorf("got error %v, want the unknown field named", err)
+	}
+}
+
+func TestRunValidateOnly(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		wantErr string // part of the error, OK is printed when empty
+	}{
+		{name: "valid", args: []string{"-input", "testdata/valid.csv", "-provider", analysis.ProviderMock}},
+		{name: "invalid row", args: []string{"-input", "testdata/golden.csv", "-provider", analysis.ProviderMock}, wantErr: `invalid gap "x"`},
+		{name: "missing environment", args: []string{"-input", "testdata/valid.csv", "-provider", analysis.ProviderSeekingAlpha}, wantErr: "missing required environment variables"},
+		{name: "invalid flag", args: []string{"-input", "testdata/valid.csv", "-provider", analysis.ProviderMock, "-min-gap", "-1"}, wantErr: "invalid -min-gap"},
+		{name: "negative news window", args: []string{"-input", "testdata/valid.csv", "-provider", analysis.ProviderMock, "-news-since", "-1h"}, wantErr: "invalid -news-since"},
+		{name: "negative retry delay", args: []string{"-input", "testdata/valid.csv", "-provider", analysis.ProviderMock, "-retry-delay", "-1s"}, wantErr: "invalid -retry-delay"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(delay time.Duration) { analysis.RetryBaseDelay = delay }(analysis.RetryBaseDelay) // set by -retry-delay
+			t.Setenv("SEEKING_ALPHA_URL", "")
+			t.Setenv("API_KEY_HEADER", "")
+			t.Setenv("API_KEY", "")
+			stdout, _, err := runCLI(t, append([]string{"-validate-only"}, tt.args...)...)
+			if (tt.wantErr!="") {
+				if (err==nil || !strings.Contains(err.Error(), tt.wantErr)) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				if (stdout!="") {
+					t.Errorf("got %q on stdout, want nothing", stdout)
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (stdout!="OK\n") {
+				t.Errorf("got %q, want OK", stdout)
+			}
+		})
+	}
+}
+
+func TestRunDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (path.Base(r.URL.Path)=="MSFT") {
+			select { // stalls until the run gives up on it
+			case <-r.Context().Done():
+				return
+			case <-time.After(5*time.Second):
+			}
+		}
+		fmt.Fprint(w, `{"data": []}`)
+	}))
+	defer server.Close()
+	t.Setenv("SEEKING_ALPHA_URL", server.URL+"/news/")
+	t.Setenv("API_KEY_HEADER", "X-Key")
+	t.Setenv("API_KEY", "secret")
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "opg.json")
+	_, _, err := runCLI(t, "-input", "testdata/valid.csv", "-provider", analysis.ProviderSeekingAlpha, "-no-cache", "-quiet", "-deadline", "300ms", "-output", output)
+	if (err==nil || !strings.Contains(err.Error(), "deadline exceeded") || !strings.Contains(err.Error(), "unfinished: MSFT")) {
+		t.Errorf("got error %v, want the deadline exceeded with MSFT unfinished", err)
+	}
+
+	selections, err := analysis.ReadSelections(filepath.Join(dir, "opg.partial.json"))
+	if (err!=nil) {
+		t.Fatalf("unexpected error reading the partial results: %v", err)
+	}
+	var tickers []string
+	for _, sel := range selections {
+		tickers = append(tickers, sel.Ticker)
+	}
+	if (!slices.Equal(tickers, []string{"AAPL"})) {
+		t.Errorf("got partial results for %q, want only AAPL", tickers)
+	}
+	_, err = os.Stat(output)
+	if (!errors.Is(err, os.ErrNotExist)) {
+		t.Errorf("got %v, want no complete output file", err)
+	}
+}
+
+func TestRunQuiet(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "opg.json")
+	stdout, stderr, err := runCLI(t, "-input", "testdata/valid.csv", "-provider", analysis.ProviderMock, "-quiet", "-output", output)
+	if (err!=nil) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if (stdout!="" || stderr!="") {
+		t.Errorf("got stdout %q and stderr %q, want nothing", stdout, stderr)
+	}
+	_, err = os.Stat(output)
+	if (err!=nil) {
+		t.Errorf("want the output written: %v", err)
+	}
+}
+
+func TestRunNoFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stocks.csv")
+	err := os.WriteFile(path, []byte("ticker,gap,opening\nBIG,0.2,50\nSMALL,0.02,50\nDOWN,-0.03,50\nBAD,6,50\n"), 0o644)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "minimum gap", want: []string{"BIG", "BAD"}},
+		{name: "no filter", args: []string{"-no-filter"}, want: []string{"BIG", "SMALL", "DOWN", "BAD"}},
+		{name: "no filter within the maximum gap", args: []string{"-no-filter", "-max-gap", "5"}, want: []string{"BIG", "SMALL", "DOWN"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-input", path, "-no-news", "-dry-run", "-quiet", "-format", "csv", "-sort", "none"}, tt.args...)
+			stdout, _, err := runCLI(t, args...)
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := csvTickers(stdout)
+			if (!slices.Equal(got, tt.want)) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunAPIKeyFile(t *testing.T) {
+	var sent atomic.Value // key received by the news server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent.Store(r.Header.Get("X-Key"))
+		fmt.Fprint(w, `{"data": []}`)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	err := os.WriteFile(keyFile, []byte("from-file\n"), 0o600)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	err = os.WriteFile(emptyFile, []byte("\n"), 0o600)
+	if (err!=nil) {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env string // API_KEY
+		file string
+		wantKey string
+		wantErr string
+	}{
+		{name: "key from the file", file: keyFile, wantKey: "from-file"},
+		{name: "file wins over the environment", env: "from-env", file: keyFile, wantKey: "from-file"},
+		{name: "environment without a file", env: "from-env", wantKey: "from-env"},
+		{name: "empty file", env: "from-env", file: emptyFile, wantErr: "file is empty"},
+		{name: "missing file", file: filepath.Join(dir, "missing"), wantErr: "invalid -api-key-file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// set first so the key the run puts in the environment is undone after the case
+			t.Setenv("SEEKING_ALPHA_URL", server.URL+"/news/")
+			t.Setenv("API_KEY_HEADER", "X-Key")
+			t.Setenv("API_KEY", tt.env)
+			sent.Store("")
+
+			args := []string{"-input", "testdata/valid.csv", "-provider", analysis.ProviderSeekingAlpha, "-no-cache", "-dry-run", "-quiet"}
+			if (tt.file!="") {
+				args = append(args, "-api-key-file", tt.file)
+			}
+			_, _, err := runCLI(t, args...)
+			if (tt.wantErr!="") {
+				if (err==nil || !strings.Contains(err.Error(), tt.wantErr)) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if (err!=nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (sent.Load()!=tt.wantKey) {
+				t.Errorf("got key %q sent, want %q", sent.Load(), tt.wantKey)
+			}
+		})
+	}
+}